@@ -0,0 +1,156 @@
+package adapter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// bounds the cluster bookkeeping done in the background
+const adapterTimeout = 5 * time.Second
+
+// message types exchanged between nodes
+const (
+	TypeChannel          = "channel"
+	TypeUser             = "user"
+	TypeTerminateUser    = "terminate_user"
+	TypeChannelsRequest  = "channels_request"
+	TypeChannelsResponse = "channels_response"
+	// reported by the adapter itself when the channels of a dead node are
+	// cleaned up, or this node takes back its channels after being mistaken
+	// for dead, so the transitions are not caused by a local subscription
+	TypeChannelOccupied = "channel_occupied"
+	TypeChannelVacated  = "channel_vacated"
+)
+
+// ErrPartialCounts is returned with the counts that did arrive when some nodes
+// did not report theirs in time, the counts are too low
+var ErrPartialCounts = errors.New("not every node reported its channel counts")
+
+// Message is forwarded between the nodes of a cluster
+type Message struct {
+	NodeID          string            `json:"node_id"`
+	Type            string            `json:"type"`
+	AppID           string            `json:"app_id"`
+	Channel         string            `json:"channel,omitempty"`
+	UserID          string            `json:"user_id,omitempty"`
+	ExcludeSocketID string            `json:"exclude_socket_id,omitempty"`
+	Payload         json.RawMessage   `json:"payload,omitempty"` // encoded pusher frame
+	Ingress         int64             `json:"ingress,omitempty"` // unix nanoseconds the event was received at, for latency metrics
+	Trace           map[string]string `json:"trace,omitempty"`   // W3C trace context of the publisher
+	RequestID       string            `json:"request_id,omitempty"`
+	Counts          map[string]int    `json:"counts,omitempty"`
+}
+
+// Handler receives channel, user and terminate messages published by other
+// nodes, and occupied and vacated transitions reported by the adapter
+type Handler func(msg *Message)
+
+// LocalState exposes the subscriptions of this node for count aggregation
+type LocalState interface {
+	LocalChannels(appID string) map[string]int
+	LocalSubscriptionCount(appID, channel string) int
+}
+
+// Adapter connects the nodes of a cluster, so that events published on one
+// node reach the subscribers connected to the others
+type Adapter interface {
+	// Start begins receiving messages from other nodes
+	Start(handler Handler, local LocalState) error
+
+	// Publish forwards a message to the other nodes
+	Publish(ctx context.Context, msg *Message) error
+
+	// Subscribe and Unsubscribe register this node's interest in the traffic of a channel,
+	// they are called when a channel becomes occupied or vacated locally. They
+	// report whether the channel became occupied or vacated across the cluster.
+	Subscribe(ctx context.Context, appID, channel string) (bool, error)
+	Unsubscribe(ctx context.Context, appID, channel string) (bool, error)
+
+	// Channels returns the cluster wide subscription count of every occupied channel of an app
+	Channels(ctx context.Context, appID string) (map[string]int, error)
+
+	// SubscriptionCount returns the cluster wide subscription count of a single channel
+	SubscriptionCount(ctx context.Context, appID, channel string) (int, error)
+
+	NodeID() string
+	Close() error
+}
+
+// NewNodeID returns a node id unique to this process
+func NewNodeID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return hex.EncodeToString(b)
+	}
+	return hostname + "-" + hex.EncodeToString(b)
+}
+
+// localCounts returns this node's counts of every channel of an app, or only
+// of channel when it is set
+func localCounts(local LocalState, appID, channel string) map[string]int {
+	if channel == "" {
+		return local.LocalChannels(appID)
+	}
+	return map[string]int{channel: local.LocalSubscriptionCount(appID, channel)}
+}
+
+type channelKey struct {
+	AppID   string `json:"app_id"`
+	Channel string `json:"channel"`
+}
+
+// occupancy is the set of channels this node has subscribers on
+type occupancy struct {
+	channels map[channelKey]bool
+	mu       sync.Mutex
+}
+
+func newOccupancy() *occupancy {
+	return &occupancy{channels: make(map[channelKey]bool)}
+}
+
+// add reports whether the channel was not in the set
+func (o *occupancy) add(appID, channel string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	key := channelKey{AppID: appID, Channel: channel}
+	if o.channels[key] {
+		return false
+	}
+	o.channels[key] = true
+	return true
+}
+
+// remove reports whether the channel was in the set
+func (o *occupancy) remove(appID, channel string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	key := channelKey{AppID: appID, Channel: channel}
+	if !o.channels[key] {
+		return false
+	}
+	delete(o.channels, key)
+	return true
+}
+
+func (o *occupancy) list() []channelKey {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	keys := make([]channelKey, 0, len(o.channels))
+	for key := range o.channels {
+		keys = append(keys, key)
+	}
+	return keys
+}
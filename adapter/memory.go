@@ -0,0 +1,56 @@
+package adapter
+
+import "context"
+
+// Memory is the single node adapter, every subscriber is local so nothing is forwarded
+type Memory struct {
+	nodeID   string
+	local    LocalState
+	occupied *occupancy
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		nodeID:   NewNodeID(),
+		occupied: newOccupancy(),
+	}
+}
+
+func (m *Memory) Start(handler Handler, local LocalState) error {
+	m.local = local
+	return nil
+}
+
+func (m *Memory) Publish(ctx context.Context, msg *Message) error {
+	return nil
+}
+
+func (m *Memory) Subscribe(ctx context.Context, appID, channel string) (bool, error) {
+	return m.occupied.add(appID, channel), nil
+}
+
+func (m *Memory) Unsubscribe(ctx context.Context, appID, channel string) (bool, error) {
+	return m.occupied.remove(appID, channel), nil
+}
+
+func (m *Memory) Channels(ctx context.Context, appID string) (map[string]int, error) {
+	if m.local == nil {
+		return map[string]int{}, nil
+	}
+	return m.local.LocalChannels(appID), nil
+}
+
+func (m *Memory) SubscriptionCount(ctx context.Context, appID, channel string) (int, error) {
+	if m.local == nil {
+		return 0, nil
+	}
+	return m.local.LocalSubscriptionCount(appID, channel), nil
+}
+
+func (m *Memory) NodeID() string {
+	return m.nodeID
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,597 @@
+package adapter
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aelpxy/pulse/liveness"
+	"github.com/charmbracelet/log"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// peers that have not announced themselves for this long are not waited for
+const natsPeerTTL = 3 * liveness.HeartbeatInterval
+
+type NATSOptions struct {
+	URL      string
+	Name     string
+	Token    string
+	User     string
+	Password string
+	Prefix   string
+}
+
+// NATS forwards messages over NATS subjects. Like the Redis adapter, channel
+// traffic uses one subject per app channel so nodes only receive events for
+// channels they have local subscribers on. Nodes announce themselves with
+// heartbeats so count requests know how many replies to wait for.
+//
+// The nodes with subscribers on a channel are kept in a JetStream key value
+// bucket, so a channel is occupied and vacated once for the whole cluster.
+// Without JetStream every node reports its own transitions.
+type NATS struct {
+	conn      *nats.Conn
+	ownsConn  bool
+	prefix    string
+	nodeID    string
+	handler   Handler
+	local     LocalState
+	kv        jetstream.KeyValue
+	occupied  *occupancy
+	liveness  *liveness.Tracker             // nil without JetStream
+	subs      map[string]*nats.Subscription // subject -> channel subscription
+	shared    []*nats.Subscription
+	subsMux   sync.Mutex
+	peers     map[string]time.Time // node id -> last heartbeat
+	peersMux  sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func NewNATS(opts NATSOptions) (*NATS, error) {
+	if opts.URL == "" {
+		opts.URL = nats.DefaultURL
+	}
+
+	natsOpts := []nats.Option{
+		nats.Name(opts.Name),
+		nats.MaxReconnects(-1),
+	}
+	if opts.Token != "" {
+		natsOpts = append(natsOpts, nats.Token(opts.Token))
+	}
+	if opts.User != "" {
+		natsOpts = append(natsOpts, nats.UserInfo(opts.User, opts.Password))
+	}
+
+	conn, err := nats.Connect(opts.URL, natsOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats at %s: %w", opts.URL, err)
+	}
+
+	n := NewNATSFromConn(conn, opts.Prefix)
+	n.ownsConn = true
+	return n, nil
+}
+
+// NewNATSFromConn uses an existing connection, e.g. to an embedded server,
+// which is left open on Close
+func NewNATSFromConn(conn *nats.Conn, prefix string) *NATS {
+	if prefix == "" {
+		prefix = "pulse."
+	}
+
+	return &NATS{
+		conn:     conn,
+		prefix:   prefix,
+		nodeID:   NewNodeID(),
+		occupied: newOccupancy(),
+		subs:     make(map[string]*nats.Subscription),
+		peers:    make(map[string]time.Time),
+		done:     make(chan struct{}),
+	}
+}
+
+// KeyValue returns the bucket holding the cluster state so other cluster
+// state can share it, nil when the server has no JetStream
+func (n *NATS) KeyValue() jetstream.KeyValue {
+	return n.kv
+}
+
+// natsToken encodes a name for use as a single subject token, channel names
+// may contain dots which would otherwise split the subject
+func natsToken(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+func (n *NATS) channelSubject(appID, channel string) string {
+	return n.prefix + "channel." + natsToken(appID) + "." + natsToken(channel)
+}
+
+func (n *NATS) usersSubject() string {
+	return n.prefix + "users"
+}
+
+func (n *NATS) requestsSubject() string {
+	return n.prefix + "requests"
+}
+
+func (n *NATS) heartbeatSubject() string {
+	return n.prefix + "heartbeat"
+}
+
+// bucketName derives the key value bucket from the subject prefix, bucket
+// names may not contain dots
+func (n *NATS) bucketName() string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, strings.Trim(n.prefix, "."))
+}
+
+func (n *NATS) channelNodesKey(appID, channel string) string {
+	return "occupancy." + natsToken(appID) + "." + natsToken(channel)
+}
+
+// openBucket creates the key value bucket, it is kept in memory since nodes
+// restore their channels when their heartbeat key disappears
+func (n *NATS) openBucket() error {
+	js, err := jetstream.New(n.conn)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), adapterTimeout)
+	defer cancel()
+
+	n.kv, err = js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:  n.bucketName(),
+		Storage: jetstream.MemoryStorage,
+	})
+	return err
+}
+
+func (n *NATS) Start(handler Handler, local LocalState) error {
+	n.handler = handler
+	n.local = local
+
+	for subject, cb := range map[string]nats.MsgHandler{
+		n.usersSubject():     n.receive,
+		n.requestsSubject():  n.answer,
+		n.heartbeatSubject(): n.heartbeat,
+	} {
+		sub, err := n.conn.Subscribe(subject, cb)
+		if err != nil {
+			n.unsubscribeAll()
+			return fmt.Errorf("failed to subscribe to %s: %w", subject, err)
+		}
+		n.shared = append(n.shared, sub)
+	}
+
+	if err := n.conn.Flush(); err != nil {
+		n.unsubscribeAll()
+		return fmt.Errorf("failed to subscribe to nats: %w", err)
+	}
+
+	if err := n.openBucket(); err != nil {
+		n.kv = nil
+		log.Warn("nats server has no jetstream, channel_occupied and channel_vacated webhooks fire per node and presence is not shared",
+			"bucket", n.bucketName(), "error", err)
+	}
+
+	if n.kv != nil {
+		n.liveness = liveness.Start("cluster", liveness.NewKeyValue(n.kv, "occupancy-nodes", n.nodeID), liveness.Handlers{
+			Restore: n.reoccupy,
+			Reap:    n.reapNodes,
+		})
+	}
+
+	n.sendHeartbeat()
+
+	n.wg.Add(1)
+	go n.sendHeartbeats()
+
+	log.Info("nats adapter started", "node", n.nodeID)
+	return nil
+}
+
+func (n *NATS) decode(m *nats.Msg) (*Message, bool) {
+	var msg Message
+	if err := json.Unmarshal(m.Data, &msg); err != nil {
+		log.Warn("invalid adapter message", "subject", m.Subject, "error", err)
+		return nil, false
+	}
+	return &msg, msg.NodeID != n.nodeID
+}
+
+func (n *NATS) receive(m *nats.Msg) {
+	if msg, ok := n.decode(m); ok {
+		n.handler(msg)
+	}
+}
+
+func (n *NATS) answer(m *nats.Msg) {
+	req, ok := n.decode(m)
+	if !ok || m.Reply == "" {
+		return
+	}
+
+	data, err := json.Marshal(&Message{
+		NodeID:    n.nodeID,
+		Type:      TypeChannelsResponse,
+		AppID:     req.AppID,
+		RequestID: req.RequestID,
+		Counts:    localCounts(n.local, req.AppID, req.Channel),
+	})
+	if err != nil {
+		return
+	}
+
+	if err := n.conn.Publish(m.Reply, data); err != nil {
+		log.Warn("failed to answer channels request", "node", req.NodeID, "error", err)
+	}
+}
+
+func (n *NATS) heartbeat(m *nats.Msg) {
+	nodeID := string(m.Data)
+	if nodeID == n.nodeID {
+		return
+	}
+
+	n.peersMux.Lock()
+	n.peers[nodeID] = time.Now()
+	n.peersMux.Unlock()
+}
+
+// sendHeartbeats announces this node to its peers, so count requests know
+// how many replies to wait for
+func (n *NATS) sendHeartbeats() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(liveness.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			n.sendHeartbeat()
+		}
+	}
+}
+
+func (n *NATS) sendHeartbeat() {
+	if err := n.conn.Publish(n.heartbeatSubject(), []byte(n.nodeID)); err != nil {
+		log.Warn("failed to send nats heartbeat", "node", n.nodeID, "error", err)
+	}
+}
+
+// reoccupy adds this node back to the channels it has subscribers on
+func (n *NATS) reoccupy(ctx context.Context) {
+	channels := n.occupied.list()
+	if len(channels) == 0 {
+		return
+	}
+
+	log.Warn("cluster heartbeat was missing, restoring channels of this node", "node", n.nodeID, "channels", len(channels))
+	for _, ch := range channels {
+		occupied, err := n.occupy(ctx, ch.AppID, ch.Channel)
+		if err != nil {
+			log.Warn("failed to restore channel", "app", ch.AppID, "channel", ch.Channel, "error", err)
+			continue
+		}
+		if occupied {
+			n.handler(&Message{NodeID: n.nodeID, Type: TypeChannelOccupied, AppID: ch.AppID, Channel: ch.Channel})
+		}
+	}
+}
+
+// reapNodes vacates the channels of dead nodes claimed by this one
+func (n *NATS) reapNodes(ctx context.Context, nodeIDs []string) {
+	dead := make(map[string]bool, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		dead[nodeID] = true
+	}
+
+	keys, err := n.listKeys(ctx, "occupancy.>")
+	if err != nil {
+		log.Warn("failed to load channels of dead nodes", "error", err)
+		return
+	}
+
+	for _, key := range keys {
+		var ch channelKey
+		vacated, err := n.updateNodes(ctx, key, func(nodes []string) []string {
+			return slices.DeleteFunc(nodes, func(nodeID string) bool { return dead[nodeID] })
+		})
+		if err != nil {
+			log.Warn("failed to vacate channel of dead node", "key", key, "error", err)
+			continue
+		}
+		if vacated && n.parseChannelKey(key, &ch) {
+			n.handler(&Message{Type: TypeChannelVacated, AppID: ch.AppID, Channel: ch.Channel})
+		}
+	}
+
+	log.Info("vacated channels of dead nodes", "nodes", len(dead))
+}
+
+func (n *NATS) listKeys(ctx context.Context, filter string) ([]string, error) {
+	lister, err := n.kv.ListKeysFiltered(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for key := range lister.Keys() {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (n *NATS) parseChannelKey(key string, ch *channelKey) bool {
+	parts := strings.Split(key, ".")
+	if len(parts) != 3 {
+		return false
+	}
+
+	appID, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	channel, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	ch.AppID, ch.Channel = string(appID), string(channel)
+	return true
+}
+
+// updateNodes changes the nodes with subscribers on a channel, retrying when
+// another node changed them concurrently. It reports whether the channel
+// went from no nodes to some or the other way around.
+func (n *NATS) updateNodes(ctx context.Context, key string, update func(nodes []string) []string) (bool, error) {
+	for {
+		var nodes []string
+		var rev uint64
+
+		entry, err := n.kv.Get(ctx, key)
+		switch {
+		case errors.Is(err, jetstream.ErrKeyNotFound):
+		case err != nil:
+			return false, err
+		default:
+			rev = entry.Revision()
+			if err := json.Unmarshal(entry.Value(), &nodes); err != nil {
+				return false, err
+			}
+		}
+
+		before := len(nodes)
+		nodes = update(nodes)
+		if len(nodes) == before {
+			return false, nil
+		}
+
+		switch {
+		case len(nodes) == 0:
+			err = n.kv.Delete(ctx, key, jetstream.LastRevision(rev))
+		case rev == 0:
+			data, _ := json.Marshal(nodes)
+			_, err = n.kv.Create(ctx, key, data)
+		default:
+			data, _ := json.Marshal(nodes)
+			_, err = n.kv.Update(ctx, key, data, rev)
+		}
+
+		if errors.Is(err, jetstream.ErrKeyExists) || errors.Is(err, jetstream.ErrKeyRevisionMismatch) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		return before == 0 || len(nodes) == 0, nil
+	}
+}
+
+func (n *NATS) occupy(ctx context.Context, appID, channel string) (bool, error) {
+	return n.updateNodes(ctx, n.channelNodesKey(appID, channel), func(nodes []string) []string {
+		if slices.Contains(nodes, n.nodeID) {
+			return nodes
+		}
+		return append(nodes, n.nodeID)
+	})
+}
+
+func (n *NATS) vacate(ctx context.Context, appID, channel string) (bool, error) {
+	return n.updateNodes(ctx, n.channelNodesKey(appID, channel), func(nodes []string) []string {
+		return slices.DeleteFunc(nodes, func(nodeID string) bool { return nodeID == n.nodeID })
+	})
+}
+
+// livePeers returns the number of other nodes that sent a recent heartbeat
+func (n *NATS) livePeers() int {
+	n.peersMux.Lock()
+	defer n.peersMux.Unlock()
+
+	count := 0
+	for nodeID, seen := range n.peers {
+		if time.Since(seen) > natsPeerTTL {
+			delete(n.peers, nodeID)
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+func (n *NATS) Publish(ctx context.Context, msg *Message) error {
+	msg.NodeID = n.nodeID
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	subject := n.usersSubject()
+	if msg.Type == TypeChannel {
+		subject = n.channelSubject(msg.AppID, msg.Channel)
+	}
+	return n.conn.Publish(subject, data)
+}
+
+func (n *NATS) Subscribe(ctx context.Context, appID, channel string) (bool, error) {
+	subject := n.channelSubject(appID, channel)
+
+	n.subsMux.Lock()
+	if _, exists := n.subs[subject]; !exists {
+		sub, err := n.conn.Subscribe(subject, n.receive)
+		if err != nil {
+			n.subsMux.Unlock()
+			return false, err
+		}
+		n.subs[subject] = sub
+	}
+	n.subsMux.Unlock()
+
+	occupied := n.occupied.add(appID, channel)
+	if n.kv == nil {
+		return occupied, nil
+	}
+	return n.occupy(ctx, appID, channel)
+}
+
+func (n *NATS) Unsubscribe(ctx context.Context, appID, channel string) (bool, error) {
+	subject := n.channelSubject(appID, channel)
+
+	n.subsMux.Lock()
+	sub, exists := n.subs[subject]
+	delete(n.subs, subject)
+	n.subsMux.Unlock()
+
+	if exists {
+		if err := sub.Unsubscribe(); err != nil {
+			return false, err
+		}
+	}
+
+	vacated := n.occupied.remove(appID, channel)
+	if n.kv == nil {
+		return vacated, nil
+	}
+	return n.vacate(ctx, appID, channel)
+}
+
+func (n *NATS) Channels(ctx context.Context, appID string) (map[string]int, error) {
+	return n.count(ctx, appID, "")
+}
+
+func (n *NATS) SubscriptionCount(ctx context.Context, appID, channel string) (int, error) {
+	counts, err := n.count(ctx, appID, channel)
+	return counts[channel], err
+}
+
+// count adds the counts of the other nodes to this node's, of every channel
+// of an app or only of channel when it is set
+func (n *NATS) count(ctx context.Context, appID, channel string) (map[string]int, error) {
+	counts := localCounts(n.local, appID, channel)
+
+	expected := n.livePeers()
+	if expected == 0 {
+		return counts, nil
+	}
+
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, countRequestTimeout)
+		defer cancel()
+	}
+
+	inbox := n.conn.NewRespInbox()
+	replies := make(chan *nats.Msg, expected)
+	sub, err := n.conn.ChanSubscribe(inbox, replies)
+	if err != nil {
+		return counts, err
+	}
+	defer sub.Unsubscribe()
+
+	data, err := json.Marshal(&Message{
+		NodeID:  n.nodeID,
+		Type:    TypeChannelsRequest,
+		AppID:   appID,
+		Channel: channel,
+	})
+	if err != nil {
+		return counts, err
+	}
+	if err := n.conn.PublishRequest(n.requestsSubject(), inbox, data); err != nil {
+		return counts, err
+	}
+
+	for received := 0; received < expected; received++ {
+		select {
+		case m := <-replies:
+			resp, ok := n.decode(m)
+			if !ok {
+				continue
+			}
+			for channel, count := range resp.Counts {
+				counts[channel] += count
+			}
+		case <-ctx.Done():
+			return counts, fmt.Errorf("%w: %d of %d nodes replied", ErrPartialCounts, received, expected)
+		}
+	}
+
+	return counts, nil
+}
+
+func (n *NATS) NodeID() string {
+	return n.nodeID
+}
+
+func (n *NATS) unsubscribeAll() {
+	n.subsMux.Lock()
+	defer n.subsMux.Unlock()
+
+	for _, sub := range n.shared {
+		sub.Unsubscribe()
+	}
+	n.shared = nil
+
+	for subject, sub := range n.subs {
+		sub.Unsubscribe()
+		delete(n.subs, subject)
+	}
+}
+
+func (n *NATS) Close() error {
+	n.closeOnce.Do(func() {
+		close(n.done)
+	})
+	n.wg.Wait()
+
+	n.unsubscribeAll()
+
+	if n.liveness != nil {
+		n.liveness.Stop()
+	}
+
+	if n.ownsConn {
+		return n.conn.Drain()
+	}
+	return n.conn.Flush()
+}
@@ -0,0 +1,251 @@
+package adapter
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// testLocal is the LocalState of a test node
+type testLocal struct {
+	mu       sync.Mutex
+	channels map[string]map[string]int
+}
+
+func (l *testLocal) LocalChannels(appID string) map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return maps.Clone(l.channels[appID])
+}
+
+func (l *testLocal) LocalSubscriptionCount(appID, channel string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.channels[appID][channel]
+}
+
+// testNode is an adapter started with a handler recording what it received
+type testNode struct {
+	*NATS
+	messages chan *Message
+}
+
+func (n *testNode) expect(t *testing.T, typ string) *Message {
+	t.Helper()
+
+	select {
+	case msg := <-n.messages:
+		if msg.Type != typ {
+			t.Fatalf("received %s message, want %s", msg.Type, typ)
+		}
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no %s message received", typ)
+		return nil
+	}
+}
+
+func (n *testNode) expectNone(t *testing.T) {
+	t.Helper()
+
+	select {
+	case msg := <-n.messages:
+		t.Fatalf("unexpected %s message for %s", msg.Type, msg.Channel)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func startNATSServer(t *testing.T, jetStream bool) string {
+	t.Helper()
+
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: jetStream, StoreDir: t.TempDir(), NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.Start()
+	t.Cleanup(ns.Shutdown)
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+	return ns.ClientURL()
+}
+
+func startNATSNode(t *testing.T, url string, local map[string]map[string]int) *testNode {
+	t.Helper()
+
+	conn, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+
+	n := &testNode{NATS: NewNATSFromConn(conn, "pulse."), messages: make(chan *Message, 16)}
+	if err := n.Start(func(msg *Message) { n.messages <- msg }, &testLocal{channels: local}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+func TestNATSForwardsChannelMessages(t *testing.T) {
+	url := startNATSServer(t, true)
+	a := startNATSNode(t, url, nil)
+	b := startNATSNode(t, url, nil)
+	c := startNATSNode(t, url, nil)
+	ctx := t.Context()
+
+	// dots in channel names must not split the subject
+	for _, n := range []*testNode{b, c} {
+		if _, err := n.Subscribe(ctx, "app", "prices.eu"); err != nil {
+			t.Fatalf("Subscribe: %v", err)
+		}
+	}
+
+	if err := a.Publish(ctx, &Message{Type: TypeChannel, AppID: "app", Channel: "prices.eu", Payload: []byte(`{"event":"tick"}`)}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	for _, n := range []*testNode{b, c} {
+		msg := n.expect(t, TypeChannel)
+		if msg.NodeID != a.NodeID() || msg.AppID != "app" || msg.Channel != "prices.eu" || string(msg.Payload) != `{"event":"tick"}` {
+			t.Errorf("received %+v, want the event published by node a", msg)
+		}
+	}
+	// a publisher does not receive its own messages, nor nodes without subscribers
+	a.expectNone(t)
+
+	if _, err := c.Unsubscribe(ctx, "app", "prices.eu"); err != nil {
+		t.Fatalf("Unsubscribe: %v", err)
+	}
+	a.Publish(ctx, &Message{Type: TypeChannel, AppID: "app", Channel: "prices.eu"})
+	b.expect(t, TypeChannel)
+	c.expectNone(t)
+
+	// the same channel of another app is a different subject
+	a.Publish(ctx, &Message{Type: TypeChannel, AppID: "other", Channel: "prices.eu"})
+	b.expectNone(t)
+}
+
+func TestNATSForwardsUserMessages(t *testing.T) {
+	url := startNATSServer(t, true)
+	a := startNATSNode(t, url, nil)
+	b := startNATSNode(t, url, nil)
+	c := startNATSNode(t, url, nil)
+
+	a.Publish(t.Context(), &Message{Type: TypeUser, AppID: "app", UserID: "alice", Payload: []byte(`{}`)})
+	for _, n := range []*testNode{b, c} {
+		if msg := n.expect(t, TypeUser); msg.UserID != "alice" || msg.AppID != "app" {
+			t.Errorf("received %+v, want a message for alice", msg)
+		}
+	}
+
+	b.Publish(t.Context(), &Message{Type: TypeTerminateUser, AppID: "app", UserID: "alice"})
+	a.expect(t, TypeTerminateUser)
+	c.expect(t, TypeTerminateUser)
+	b.expectNone(t)
+}
+
+func TestNATSChannelsSumsNodes(t *testing.T) {
+	url := startNATSServer(t, true)
+	a := startNATSNode(t, url, map[string]map[string]int{
+		"app":   {"lobby": 2, "prices": 1},
+		"other": {"lobby": 5},
+	})
+	startNATSNode(t, url, map[string]map[string]int{
+		"app": {"lobby": 3, "orders": 4},
+	})
+
+	want := map[string]int{"lobby": 5, "prices": 1, "orders": 4}
+
+	// node a knows node b once its first heartbeat arrived
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		counts, err := a.Channels(t.Context(), "app")
+		if err != nil {
+			t.Fatalf("Channels: %v", err)
+		}
+		if maps.Equal(counts, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("channels = %v, want %v", counts, want)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if count, err := a.SubscriptionCount(t.Context(), "app", "orders"); err != nil || count != 4 {
+		t.Errorf("SubscriptionCount = %d, %v, want 4 from node b", count, err)
+	}
+}
+
+func TestNATSChannelsReportsMissingNodes(t *testing.T) {
+	url := startNATSServer(t, true)
+	a := startNATSNode(t, url, map[string]map[string]int{
+		"app": {"lobby": 2},
+	})
+
+	// a node that sent a heartbeat but does not answer
+	a.peersMux.Lock()
+	a.peers["silent"] = time.Now()
+	a.peersMux.Unlock()
+
+	ctx, cancel := context.WithTimeout(t.Context(), 200*time.Millisecond)
+	defer cancel()
+
+	counts, err := a.Channels(ctx, "app")
+	if !errors.Is(err, ErrPartialCounts) {
+		t.Fatalf("Channels error = %v, want ErrPartialCounts", err)
+	}
+	if counts["lobby"] != 2 {
+		t.Errorf("channels = %v, want this node's lobby:2", counts)
+	}
+}
+
+func TestNATSOccupiesChannelsOnce(t *testing.T) {
+	url := startNATSServer(t, true)
+	a := startNATSNode(t, url, nil)
+	b := startNATSNode(t, url, nil)
+	ctx := t.Context()
+
+	steps := []struct {
+		node *testNode
+		op   func(n *testNode, ctx context.Context, appID, channel string) (bool, error)
+		want bool
+	}{
+		{a, (*testNode).Subscribe, true},
+		{b, (*testNode).Subscribe, false},
+		{a, (*testNode).Unsubscribe, false},
+		{b, (*testNode).Unsubscribe, true},
+	}
+	for i, step := range steps {
+		changed, err := step.op(step.node, ctx, "app", "lobby")
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if changed != step.want {
+			t.Errorf("step %d reported a cluster transition = %v, want %v", i, changed, step.want)
+		}
+	}
+}
+
+func TestNATSWithoutJetStream(t *testing.T) {
+	url := startNATSServer(t, false)
+	a := startNATSNode(t, url, nil)
+
+	if a.KeyValue() != nil {
+		t.Fatal("KeyValue is set without jetstream")
+	}
+
+	// every node reports its own transitions
+	if occupied, err := a.Subscribe(t.Context(), "app", "lobby"); err != nil || !occupied {
+		t.Errorf("Subscribe = %v, %v, want the local transition", occupied, err)
+	}
+	if vacated, err := a.Unsubscribe(t.Context(), "app", "lobby"); err != nil || !vacated {
+		t.Errorf("Unsubscribe = %v, %v, want the local transition", vacated, err)
+	}
+}
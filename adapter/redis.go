@@ -0,0 +1,412 @@
+package adapter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aelpxy/pulse/liveness"
+	"github.com/charmbracelet/log"
+	"github.com/redis/go-redis/v9"
+)
+
+// how long Channels waits for the other nodes to report their counts
+const countRequestTimeout = time.Second
+
+// occupyScript adds a node to the nodes with subscribers on a channel and
+// returns 1 when it is the first one
+//
+// KEYS: channel nodes, node entries
+// ARGV: node id, node entry
+var occupyScript = redis.NewScript(`
+redis.call('SADD', KEYS[2], ARGV[2])
+if redis.call('SADD', KEYS[1], ARGV[1]) == 1 and redis.call('SCARD', KEYS[1]) == 1 then
+	return 1
+end
+return 0
+`)
+
+// vacateScript removes a node from the nodes with subscribers on a channel
+// and returns 1 when it was the last one
+//
+// KEYS: channel nodes, node entries
+// ARGV: node id, node entry
+var vacateScript = redis.NewScript(`
+redis.call('SREM', KEYS[2], ARGV[2])
+if redis.call('SREM', KEYS[1], ARGV[1]) == 1 and redis.call('SCARD', KEYS[1]) == 0 then
+	return 1
+end
+return 0
+`)
+
+type RedisOptions struct {
+	Addr     string
+	Password string
+	DB       int
+	PoolSize int
+	Prefix   string
+}
+
+// Redis forwards messages over Redis pub/sub. Channel traffic uses one pub/sub
+// channel per app channel, so nodes only receive events for channels they
+// have local subscribers on. Counts are aggregated by asking every node.
+//
+// The nodes with subscribers on a channel are kept in a set, so a channel is
+// occupied and vacated once for the whole cluster. Nodes send heartbeats to a
+// sorted set, and the channels of a node that stops sending them are vacated
+// by whichever node claims it first.
+type Redis struct {
+	client     *redis.Client
+	pubsub     *redis.PubSub
+	prefix     string
+	nodeID     string
+	handler    Handler
+	local      LocalState
+	occupied   *occupancy
+	pending    map[string]chan *Message
+	pendingMux sync.Mutex
+	liveness   *liveness.Tracker
+	wg         sync.WaitGroup
+}
+
+func NewRedis(opts RedisOptions) (*Redis, error) {
+	if opts.Prefix == "" {
+		opts.Prefix = "pulse:"
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     opts.Addr,
+		Password: opts.Password,
+		DB:       opts.DB,
+		PoolSize: opts.PoolSize,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis at %s: %w", opts.Addr, err)
+	}
+
+	return NewRedisFromClient(client, opts.Prefix), nil
+}
+
+// NewRedisFromClient uses an existing client, which is closed on Close
+func NewRedisFromClient(client *redis.Client, prefix string) *Redis {
+	if prefix == "" {
+		prefix = "pulse:"
+	}
+
+	return &Redis{
+		client:   client,
+		prefix:   prefix,
+		nodeID:   NewNodeID(),
+		occupied: newOccupancy(),
+		pending:  make(map[string]chan *Message),
+	}
+}
+
+// Client returns the underlying redis client so other cluster state can share the connection pool
+func (r *Redis) Client() *redis.Client {
+	return r.client
+}
+
+func (r *Redis) channelKey(appID, channel string) string {
+	return r.prefix + "channel:" + appID + ":" + channel
+}
+
+func (r *Redis) usersKey() string {
+	return r.prefix + "users"
+}
+
+func (r *Redis) requestsKey() string {
+	return r.prefix + "requests"
+}
+
+func (r *Redis) responsesKey(nodeID string) string {
+	return r.prefix + "responses:" + nodeID
+}
+
+func (r *Redis) channelNodesKey(appID, channel string) string {
+	return r.prefix + "occupancy:" + appID + ":" + channel + ":nodes"
+}
+
+func (r *Redis) nodesKey() string {
+	return r.prefix + "occupancy:nodes"
+}
+
+func (r *Redis) nodeEntriesKey(nodeID string) string {
+	return r.prefix + "occupancy:node:" + nodeID
+}
+
+func (r *Redis) Start(handler Handler, local LocalState) error {
+	r.handler = handler
+	r.local = local
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r.pubsub = r.client.Subscribe(ctx, r.usersKey(), r.requestsKey(), r.responsesKey(r.nodeID))
+	if _, err := r.pubsub.Receive(ctx); err != nil {
+		r.pubsub.Close()
+		return fmt.Errorf("failed to subscribe to redis: %w", err)
+	}
+
+	r.liveness = liveness.Start("cluster", liveness.NewRedis(r.client, r.nodesKey(), r.nodeID), liveness.Handlers{
+		Restore: r.reoccupy,
+		Reap:    r.reapNodes,
+	})
+
+	r.wg.Add(1)
+	go r.receive()
+
+	log.Info("redis adapter started", "node", r.nodeID)
+	return nil
+}
+
+func (r *Redis) receive() {
+	defer r.wg.Done()
+
+	for m := range r.pubsub.Channel() {
+		var msg Message
+		if err := json.Unmarshal([]byte(m.Payload), &msg); err != nil {
+			log.Warn("invalid adapter message", "channel", m.Channel, "error", err)
+			continue
+		}
+
+		if msg.NodeID == r.nodeID {
+			continue
+		}
+
+		switch msg.Type {
+		case TypeChannelsRequest:
+			go r.answer(&msg)
+		case TypeChannelsResponse:
+			r.pendingMux.Lock()
+			waiter, exists := r.pending[msg.RequestID]
+			r.pendingMux.Unlock()
+			if exists {
+				select {
+				case waiter <- &msg:
+				default:
+				}
+			}
+		default:
+			r.handler(&msg)
+		}
+	}
+}
+
+func (r *Redis) answer(req *Message) {
+	resp := &Message{
+		NodeID:    r.nodeID,
+		Type:      TypeChannelsResponse,
+		AppID:     req.AppID,
+		RequestID: req.RequestID,
+		Counts:    localCounts(r.local, req.AppID, req.Channel),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), countRequestTimeout)
+	defer cancel()
+
+	if err := r.publish(ctx, r.responsesKey(req.NodeID), resp); err != nil {
+		log.Warn("failed to answer channels request", "node", req.NodeID, "error", err)
+	}
+}
+
+func (r *Redis) publish(ctx context.Context, key string, msg *Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return r.client.Publish(ctx, key, data).Err()
+}
+
+func (r *Redis) Publish(ctx context.Context, msg *Message) error {
+	msg.NodeID = r.nodeID
+
+	key := r.usersKey()
+	if msg.Type == TypeChannel {
+		key = r.channelKey(msg.AppID, msg.Channel)
+	}
+	return r.publish(ctx, key, msg)
+}
+
+func (r *Redis) Subscribe(ctx context.Context, appID, channel string) (bool, error) {
+	if err := r.pubsub.Subscribe(ctx, r.channelKey(appID, channel)); err != nil {
+		return false, err
+	}
+
+	r.occupied.add(appID, channel)
+	return r.occupy(ctx, appID, channel)
+}
+
+func (r *Redis) Unsubscribe(ctx context.Context, appID, channel string) (bool, error) {
+	if err := r.pubsub.Unsubscribe(ctx, r.channelKey(appID, channel)); err != nil {
+		return false, err
+	}
+
+	r.occupied.remove(appID, channel)
+	return r.vacate(ctx, appID, channel, r.nodeID)
+}
+
+func (r *Redis) occupy(ctx context.Context, appID, channel string) (bool, error) {
+	entry, _ := json.Marshal(channelKey{AppID: appID, Channel: channel})
+	keys := []string{r.channelNodesKey(appID, channel), r.nodeEntriesKey(r.nodeID)}
+	occupied, err := occupyScript.Run(ctx, r.client, keys, r.nodeID, entry).Int()
+	return occupied == 1, err
+}
+
+func (r *Redis) vacate(ctx context.Context, appID, channel, nodeID string) (bool, error) {
+	entry, _ := json.Marshal(channelKey{AppID: appID, Channel: channel})
+	keys := []string{r.channelNodesKey(appID, channel), r.nodeEntriesKey(nodeID)}
+	vacated, err := vacateScript.Run(ctx, r.client, keys, nodeID, entry).Int()
+	return vacated == 1, err
+}
+
+// reoccupy adds this node back to the channels it has subscribers on
+func (r *Redis) reoccupy(ctx context.Context) {
+	channels := r.occupied.list()
+	if len(channels) == 0 {
+		return
+	}
+
+	log.Warn("cluster heartbeat was missing, restoring channels of this node", "node", r.nodeID, "channels", len(channels))
+	for _, ch := range channels {
+		occupied, err := r.occupy(ctx, ch.AppID, ch.Channel)
+		if err != nil {
+			log.Warn("failed to restore channel", "app", ch.AppID, "channel", ch.Channel, "error", err)
+			continue
+		}
+		if occupied {
+			r.handler(&Message{NodeID: r.nodeID, Type: TypeChannelOccupied, AppID: ch.AppID, Channel: ch.Channel})
+		}
+	}
+}
+
+// reapNodes vacates the channels of dead nodes claimed by this one
+func (r *Redis) reapNodes(ctx context.Context, nodeIDs []string) {
+	for _, nodeID := range nodeIDs {
+		r.reapNode(ctx, nodeID)
+	}
+}
+
+func (r *Redis) reapNode(ctx context.Context, nodeID string) {
+	entries, err := r.client.SMembers(ctx, r.nodeEntriesKey(nodeID)).Result()
+	if err != nil {
+		log.Warn("failed to load channels of dead node", "node", nodeID, "error", err)
+		return
+	}
+
+	for _, raw := range entries {
+		var ch channelKey
+		if err := json.Unmarshal([]byte(raw), &ch); err != nil {
+			continue
+		}
+
+		vacated, err := r.vacate(ctx, ch.AppID, ch.Channel, nodeID)
+		if err != nil {
+			log.Warn("failed to vacate channel of dead node", "node", nodeID, "app", ch.AppID, "channel", ch.Channel, "error", err)
+			continue
+		}
+		if vacated {
+			r.handler(&Message{NodeID: nodeID, Type: TypeChannelVacated, AppID: ch.AppID, Channel: ch.Channel})
+		}
+	}
+
+	r.client.Del(ctx, r.nodeEntriesKey(nodeID))
+	log.Info("vacated channels of dead node", "node", nodeID, "channels", len(entries))
+}
+
+func (r *Redis) Channels(ctx context.Context, appID string) (map[string]int, error) {
+	return r.count(ctx, appID, "")
+}
+
+func (r *Redis) SubscriptionCount(ctx context.Context, appID, channel string) (int, error) {
+	counts, err := r.count(ctx, appID, channel)
+	return counts[channel], err
+}
+
+// count adds the counts of the other nodes to this node's, of every channel
+// of an app or only of channel when it is set
+func (r *Redis) count(ctx context.Context, appID, channel string) (map[string]int, error) {
+	counts := localCounts(r.local, appID, channel)
+
+	// every node holds one subscription to the requests channel
+	numSub, err := r.client.PubSubNumSub(ctx, r.requestsKey()).Result()
+	if err != nil {
+		return counts, err
+	}
+	expected := int(numSub[r.requestsKey()]) - 1
+	if expected <= 0 {
+		return counts, nil
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	requestID := hex.EncodeToString(b)
+
+	waiter := make(chan *Message, expected)
+	r.pendingMux.Lock()
+	r.pending[requestID] = waiter
+	r.pendingMux.Unlock()
+
+	defer func() {
+		r.pendingMux.Lock()
+		delete(r.pending, requestID)
+		r.pendingMux.Unlock()
+	}()
+
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, countRequestTimeout)
+		defer cancel()
+	}
+
+	req := &Message{
+		NodeID:    r.nodeID,
+		Type:      TypeChannelsRequest,
+		AppID:     appID,
+		Channel:   channel,
+		RequestID: requestID,
+	}
+	if err := r.publish(ctx, r.requestsKey(), req); err != nil {
+		return counts, err
+	}
+
+	for received := 0; received < expected; received++ {
+		select {
+		case resp := <-waiter:
+			for channel, count := range resp.Counts {
+				counts[channel] += count
+			}
+		case <-ctx.Done():
+			return counts, fmt.Errorf("%w: %d of %d nodes replied", ErrPartialCounts, received, expected)
+		}
+	}
+
+	return counts, nil
+}
+
+func (r *Redis) NodeID() string {
+	return r.nodeID
+}
+
+// Close stops the heartbeat and deregisters this node, its channels are
+// expected to have been vacated as its connections closed
+func (r *Redis) Close() error {
+	if r.liveness != nil {
+		r.liveness.Stop()
+	}
+	if r.pubsub != nil {
+		r.pubsub.Close()
+	}
+	r.wg.Wait()
+
+	return r.client.Close()
+}
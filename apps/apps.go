@@ -1,33 +1,140 @@
 package apps
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"os"
+	"slices"
 	"sync"
+	"time"
+
+	"github.com/aelpxy/pulse/auth"
+	"github.com/charmbracelet/log"
 )
 
 type App struct {
-	ID                 string   `json:"id"`
-	Key                string   `json:"key"`
-	Secret             string   `json:"secret"`
-	Name               string   `json:"name"`
-	Enabled            bool     `json:"enabled"`
-	MaxConnections     int      `json:"max_connections"`
-	MaxChannelsPerConn int      `json:"max_channels_per_connection"`
-	AllowedOrigins     []string `json:"allowed_origins"`
-	MaxMessageSize     int64    `json:"max_message_size"`
-	MaxBatchEvents     int      `json:"max_batch_events"`
-	EnableClientEvents *bool    `json:"enable_client_events"`
-	MaxEventRate       int      `json:"max_event_rate"`
-	MaxEventBurst      int      `json:"max_event_burst"`
+	ID                 string    `json:"id"`
+	Key                string    `json:"key"`
+	Secret             string    `json:"secret"`
+	Name               string    `json:"name"`
+	Enabled            bool      `json:"enabled"`
+	MaxConnections     int       `json:"max_connections"`
+	MaxChannelsPerConn int       `json:"max_channels_per_connection"`
+	AllowedOrigins     []string  `json:"allowed_origins"`
+	MaxMessageSize     int64     `json:"max_message_size"`
+	MaxBatchEvents     int       `json:"max_batch_events"`
+	EnableClientEvents *bool     `json:"enable_client_events"`
+	MaxEventRate       int       `json:"max_event_rate"`
+	MaxEventBurst      int       `json:"max_event_burst"`
+	Webhooks           []Webhook `json:"webhooks"`
+	SlowConsumerPolicy string    `json:"slow_consumer_policy"`
+	// Secrets are accepted next to Secret while rotating, Secret stays the
+	// primary used to sign outgoing webhooks
+	Secrets []Secret `json:"secrets,omitempty"`
+	// Keys are additional key/secret pairs for backend services, they sign
+	// HTTP API requests and channel auth but clients connect with Key
+	Keys []AppKey `json:"keys,omitempty"`
+}
+
+// AppKey is an additional key of an app. Read only keys may only query the
+// HTTP API, they can't trigger events or sign channel auth.
+type AppKey struct {
+	Key      string `json:"key"`
+	Secret   string `json:"secret"`
+	ReadOnly bool   `json:"read_only"`
+	Enabled  *bool  `json:"enabled"`
+}
+
+// enabled by default
+func (k AppKey) IsEnabled() bool {
+	return k.Enabled == nil || *k.Enabled
+}
+
+// Secret is an additional app secret, valid until ExpiresAt when set
+type Secret struct {
+	Secret    string     `json:"secret"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (s Secret) Expired(now time.Time) bool {
+	return s.ExpiresAt != nil && !now.Before(*s.ExpiresAt)
+}
+
+// slow consumer policies, applied when a connection's send buffer is full
+const (
+	SlowConsumerDrop       = "drop"
+	SlowConsumerDropOldest = "drop_oldest"
+	SlowConsumerDisconnect = "disconnect"
+)
+
+type Webhook struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
 }
 
 type ServerConfig struct {
-	Debug    bool   `json:"debug"`
-	Port     string `json:"port"`
-	Hostname string `json:"hostname"`
-	Region   string `json:"region"`
+	Debug    bool          `json:"debug"`
+	Port     string        `json:"port"`
+	Hostname string        `json:"hostname"`
+	Region   string        `json:"region"`
+	Adapter  AdapterConfig `json:"adapter"`
+	AppStore StoreConfig   `json:"app_store"`
+	Admin    AdminConfig   `json:"admin"`
+	Tracing  TracingConfig `json:"tracing"`
+	Audit    AuditConfig   `json:"audit"`
+}
+
+// AuditConfig enables the audit log of security relevant events when a path is set
+type AuditConfig struct {
+	Path string `json:"path"` // file to append JSON lines to, or stdout
+}
+
+// TracingConfig exports OpenTelemetry traces over OTLP/HTTP, tracing is off unless enabled
+type TracingConfig struct {
+	Enabled     bool              `json:"enabled"`
+	Endpoint    string            `json:"endpoint"` // collector url, defaults to the OTEL_EXPORTER_OTLP_* environment or http://localhost:4318
+	Headers     map[string]string `json:"headers"`
+	ServiceName string            `json:"service_name"` // default pulse
+	SampleRatio *float64          `json:"sample_ratio"` // fraction of new traces recorded, default 1
+}
+
+// AdminConfig enables the admin API when a token is set
+type AdminConfig struct {
+	Token   string `json:"token"`
+	Port    string `json:"port"`    // separate listener, otherwise served under /admin/ on the main port
+	Persist bool   `json:"persist"` // write changes back to the config file when apps are loaded from it
+}
+
+// StoreConfig selects where apps are loaded from, the config file by default
+type StoreConfig struct {
+	Driver           string `json:"driver"` // file (default), sqlite, postgres or mysql
+	DSN              string `json:"dsn"`
+	Table            string `json:"table"`
+	CacheTTL         int    `json:"cache_ttl"`          // seconds
+	NegativeCacheTTL int    `json:"negative_cache_ttl"` // seconds
+}
+
+// AdapterConfig selects how nodes of a cluster exchange events
+type AdapterConfig struct {
+	Driver string      `json:"driver"` // memory (default), redis or nats
+	Redis  RedisConfig `json:"redis"`
+	NATS   NATSConfig  `json:"nats"`
+}
+
+type RedisConfig struct {
+	Addr     string `json:"addr"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+	PoolSize int    `json:"pool_size"`
+	Prefix   string `json:"prefix"`
+}
+
+type NATSConfig struct {
+	URL      string `json:"url"`
+	Token    string `json:"token"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Prefix   string `json:"prefix"`
 }
 
 type Config struct {
@@ -35,47 +142,53 @@ type Config struct {
 	Apps   []App        `json:"apps"`
 }
 
+// how long Manager waits for its store before treating an app as missing
+const storeTimeout = 5 * time.Second
+
 type Manager struct {
-	apps         map[string]*App // key -> app
-	appsById     map[string]*App // id -> app
+	store        AppStore
 	serverConfig ServerConfig
 	mu           sync.RWMutex
 }
 
 func NewManager() *Manager {
 	return &Manager{
-		apps:     make(map[string]*App),
-		appsById: make(map[string]*App),
+		store: NewFileStore(),
 	}
 }
 
-func (m *Manager) LoadFromFile(filename string) (*ServerConfig, error) {
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read apps config: %w", err)
-	}
-
-	var config Config
-	if err := json.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse apps config: %w", err)
-	}
-
+// SetStore replaces the source of apps, e.g. with a SQLStore
+func (m *Manager) SetStore(store AppStore) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.store = store
+}
 
-	m.serverConfig = config.Server
+func (m *Manager) getStore() AppStore {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.store
+}
 
-	m.apps = make(map[string]*App)
-	m.appsById = make(map[string]*App)
+// LoadFromFile reads the server config from a config file, apps are loaded
+// from it as well unless they come from another store
+func (m *Manager) LoadFromFile(filename string) (*ServerConfig, error) {
+	var config *Config
+	var err error
 
-	for i := range config.Apps {
-		app := &config.Apps[i]
-		if app.Enabled {
-			m.apps[app.Key] = app
-			m.appsById[app.ID] = app
-		}
+	if fileStore, ok := m.getStore().(*FileStore); ok {
+		config, err = fileStore.Load(filename)
+	} else {
+		config, err = ReadConfig(filename)
+	}
+	if err != nil {
+		return nil, err
 	}
 
+	m.mu.Lock()
+	m.serverConfig = config.Server
+	m.mu.Unlock()
+
 	return &config.Server, nil
 }
 
@@ -86,26 +199,45 @@ func (m *Manager) GetServerConfig() ServerConfig {
 }
 
 func (m *Manager) GetApp(key string) (*App, bool) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	app, exists := m.apps[key]
-	return app, exists
+	app, err := m.LookupApp(key)
+	return app, err == nil
+}
+
+// LookupApp is GetApp reporting why no app was returned, ErrAppDisabled,
+// ErrAppNotFound or the error of the store
+func (m *Manager) LookupApp(key string) (*App, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	app, err := m.getStore().GetApp(ctx, key)
+	if err != nil && !errors.Is(err, ErrAppNotFound) {
+		log.Error("failed to look up app", "key", key, "error", err)
+	}
+	return app, err
 }
 
 func (m *Manager) GetAppByID(id string) (*App, bool) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	app, exists := m.appsById[id]
-	return app, exists
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	app, err := m.getStore().GetAppByID(ctx, id)
+	if err != nil {
+		if !errors.Is(err, ErrAppNotFound) {
+			log.Error("failed to look up app", "id", id, "error", err)
+		}
+		return nil, false
+	}
+	return app, true
 }
 
 func (m *Manager) GetAllApps() []*App {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
 
-	apps := make([]*App, 0, len(m.apps))
-	for _, app := range m.apps {
-		apps = append(apps, app)
+	apps, err := m.getStore().GetAllApps(ctx)
+	if err != nil {
+		log.Error("failed to list apps", "error", err)
+		return []*App{}
 	}
 	return apps
 }
@@ -120,29 +252,169 @@ func (m *Manager) ValidateApp(key, secret string) (*App, error) {
 		return nil, fmt.Errorf("app disabled: %s", key)
 	}
 
-	if app.Secret != secret {
+	if !slices.Contains(app.ActiveSecrets(), secret) {
 		return nil, fmt.Errorf("invalid app secret")
 	}
 
 	return app, nil
 }
 
+func (m *Manager) writableStore() (WritableStore, error) {
+	if store, ok := m.getStore().(WritableStore); ok {
+		return store, nil
+	}
+	return nil, ErrReadOnlyStore
+}
+
+// ListApps returns every app, including disabled ones
+func (m *Manager) ListApps() ([]*App, error) {
+	store, err := m.writableStore()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	return store.ListApps(ctx)
+}
+
+// FindApp returns an app by id, including disabled ones
+func (m *Manager) FindApp(id string) (*App, error) {
+	apps, err := m.ListApps()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, app := range apps {
+		if app.ID == id {
+			return app, nil
+		}
+	}
+	return nil, ErrAppNotFound
+}
+
+func (m *Manager) CreateApp(app *App) error {
+	store, err := m.writableStore()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	return store.CreateApp(ctx, app)
+}
+
+func (m *Manager) UpdateApp(app *App) error {
+	store, err := m.writableStore()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	return store.UpdateApp(ctx, app)
+}
+
+func (m *Manager) DeleteApp(id string) error {
+	store, err := m.writableStore()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	return store.DeleteApp(ctx, id)
+}
+
+// IsFileStore reports whether apps are loaded from the config file
+func (m *Manager) IsFileStore() bool {
+	_, ok := m.getStore().(*FileStore)
+	return ok
+}
+
+// AddApp and RemoveApp only apply to apps loaded from a file
 func (m *Manager) AddApp(app *App) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.apps[app.Key] = app
+	if fileStore, ok := m.getStore().(*FileStore); ok {
+		fileStore.AddApp(app)
+	}
 }
 
 func (m *Manager) RemoveApp(key string) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	delete(m.apps, key)
+	if fileStore, ok := m.getStore().(*FileStore); ok {
+		fileStore.RemoveApp(key)
+	}
 }
 
 func (m *Manager) GetAppCount() int {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	return len(m.apps)
+	return len(m.GetAllApps())
+}
+
+func (m *Manager) Close() error {
+	return m.getStore().Close()
+}
+
+// Clone returns a copy of the app that can be changed without affecting
+// connections still reading the original
+func (a *App) Clone() *App {
+	clone := *a
+	clone.AllowedOrigins = slices.Clone(a.AllowedOrigins)
+	clone.Webhooks = slices.Clone(a.Webhooks)
+	clone.Secrets = slices.Clone(a.Secrets)
+	clone.Keys = slices.Clone(a.Keys)
+	for i := range clone.Keys {
+		if enabled := a.Keys[i].Enabled; enabled != nil {
+			enabled := *enabled
+			clone.Keys[i].Enabled = &enabled
+		}
+	}
+	for i := range clone.Webhooks {
+		clone.Webhooks[i].EventTypes = slices.Clone(a.Webhooks[i].EventTypes)
+	}
+	if a.EnableClientEvents != nil {
+		enabled := *a.EnableClientEvents
+		clone.EnableClientEvents = &enabled
+	}
+	return &clone
+}
+
+// ActiveSecrets returns the primary secret followed by the additional
+// secrets that haven't expired, signatures made with any of them are valid
+func (a *App) ActiveSecrets() []string {
+	now := time.Now()
+	secrets := []string{a.Secret}
+	for _, s := range a.Secrets {
+		if s.Secret != "" && !s.Expired(now) {
+			secrets = append(secrets, s.Secret)
+		}
+	}
+	return secrets
+}
+
+// FindKey returns the additional key with the given value if it is enabled
+func (a *App) FindKey(key string) (AppKey, bool) {
+	for _, k := range a.Keys {
+		if k.Key == key && k.IsEnabled() {
+			return k, true
+		}
+	}
+	return AppKey{}, false
+}
+
+// HasKey reports whether key is the app key or one of its additional keys
+func (a *App) HasKey(key string) bool {
+	return a.Key == key || slices.ContainsFunc(a.Keys, func(k AppKey) bool { return k.Key == key })
+}
+
+// AuthService returns an auth service accepting signatures of the app key and
+// its enabled additional keys, read only keys are only included when readOnly is set
+func (a *App) AuthService(readOnly bool) *auth.Service {
+	svc := auth.NewService(a.Key, a.ActiveSecrets()...)
+	for _, k := range a.Keys {
+		if k.Key != a.Key && k.IsEnabled() && (readOnly || !k.ReadOnly) {
+			svc.AddKey(k.Key, k.Secret)
+		}
+	}
+	return svc
 }
 
 // 8KB default
@@ -188,3 +460,30 @@ func (a *App) GetMaxEventBurst() int {
 	}
 	return a.MaxEventBurst
 }
+
+// GetSlowConsumerPolicy defaults to dropping new messages for unknown values
+func (a *App) GetSlowConsumerPolicy() string {
+	switch a.SlowConsumerPolicy {
+	case SlowConsumerDropOldest, SlowConsumerDisconnect:
+		return a.SlowConsumerPolicy
+	default:
+		return SlowConsumerDrop
+	}
+}
+
+// Accepts reports whether the webhook subscribes to the event type, an empty filter accepts all
+func (w *Webhook) Accepts(eventType string) bool {
+	if len(w.EventTypes) == 0 {
+		return true
+	}
+	return slices.Contains(w.EventTypes, eventType)
+}
+
+func (a *App) HasWebhook(eventType string) bool {
+	for i := range a.Webhooks {
+		if a.Webhooks[i].Accepts(eventType) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package apps
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSecretExpired(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) *time.Time {
+		expiry := now.Add(d)
+		return &expiry
+	}
+
+	tests := []struct {
+		name      string
+		expiresAt *time.Time
+		expired   bool
+	}{
+		{"no expiry", nil, false},
+		{"before expiry", at(time.Nanosecond), false},
+		{"at expiry", at(0), true},
+		{"after expiry", at(-time.Nanosecond), true},
+	}
+
+	for _, tt := range tests {
+		if got := (Secret{Secret: "s", ExpiresAt: tt.expiresAt}).Expired(now); got != tt.expired {
+			t.Errorf("%s: Expired = %v, want %v", tt.name, got, tt.expired)
+		}
+	}
+}
+
+func TestActiveSecrets(t *testing.T) {
+	later, earlier := time.Now().Add(time.Hour), time.Now().Add(-time.Hour)
+	app := App{Secret: "primary", Secrets: []Secret{
+		{Secret: "rotated", ExpiresAt: &later},
+		{Secret: "expired", ExpiresAt: &earlier},
+		{Secret: ""},
+		{Secret: "permanent"},
+	}}
+
+	// the primary always comes first, it signs outgoing webhooks
+	if got, want := app.ActiveSecrets(), []string{"primary", "rotated", "permanent"}; !slices.Equal(got, want) {
+		t.Errorf("ActiveSecrets = %v, want %v", got, want)
+	}
+}
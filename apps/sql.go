@@ -0,0 +1,376 @@
+package apps
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	defaultCacheTTL         = 30 * time.Second
+	defaultNegativeCacheTTL = 5 * time.Second
+	// negative entries are only cached while the cache is below this size,
+	// so lookups of random keys can't grow it without bound
+	maxCacheEntries = 10000
+)
+
+var tableNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// database/sql driver names of the supported databases
+var sqlDrivers = map[string]string{
+	"sqlite":   "sqlite",
+	"postgres": "pgx",
+	"mysql":    "mysql",
+}
+
+type SQLOptions struct {
+	Driver           string // sqlite, postgres or mysql
+	DSN              string
+	Table            string
+	CacheTTL         time.Duration
+	NegativeCacheTTL time.Duration
+}
+
+type cacheEntry struct {
+	app      *App // nil when the app does not exist or is disabled
+	disabled bool
+	expires  time.Time
+}
+
+// SQLStore loads apps from a database table. Lookups are cached for
+// CacheTTL, missing apps for NegativeCacheTTL, and a cached app keeps being
+// served while the database is unreachable.
+//
+// The table holds one row per app, properties other than the columns below
+// are stored as a JSON object in the same format as the config file:
+//
+//	id VARCHAR(255) PRIMARY KEY, app_key VARCHAR(255) UNIQUE NOT NULL,
+//	secret VARCHAR(255) NOT NULL, name VARCHAR(255), enabled BOOLEAN, settings TEXT
+type SQLStore struct {
+	db       *sql.DB
+	driver   string
+	table    string
+	ttl      time.Duration
+	negTTL   time.Duration
+	byKey    map[string]cacheEntry
+	byID     map[string]cacheEntry
+	cacheMux sync.Mutex
+}
+
+func NewSQLStore(opts SQLOptions) (*SQLStore, error) {
+	driverName, supported := sqlDrivers[opts.Driver]
+	if !supported {
+		return nil, fmt.Errorf("unsupported app store driver: %s", opts.Driver)
+	}
+
+	if opts.Table == "" {
+		opts.Table = "apps"
+	}
+	if !tableNameRegex.MatchString(opts.Table) {
+		return nil, fmt.Errorf("invalid app store table name: %q", opts.Table)
+	}
+	if opts.CacheTTL <= 0 {
+		opts.CacheTTL = defaultCacheTTL
+	}
+	if opts.NegativeCacheTTL <= 0 {
+		opts.NegativeCacheTTL = defaultNegativeCacheTTL
+	}
+
+	db, err := sql.Open(driverName, opts.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open app store: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to app store: %w", err)
+	}
+
+	return &SQLStore{
+		db:     db,
+		driver: opts.Driver,
+		table:  opts.Table,
+		ttl:    opts.CacheTTL,
+		negTTL: opts.NegativeCacheTTL,
+		byKey:  make(map[string]cacheEntry),
+		byID:   make(map[string]cacheEntry),
+	}, nil
+}
+
+// placeholder returns the n-th (1 based) bind parameter of the driver
+func (s *SQLStore) placeholder(n int) string {
+	if s.driver == "postgres" {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+func (s *SQLStore) selectQuery(where string) string {
+	query := "SELECT id, app_key, secret, name, enabled, settings FROM " + s.table
+	if where != "" {
+		query += " WHERE " + where + " = " + s.placeholder(1)
+	}
+	return query
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanApp(row rowScanner) (*App, error) {
+	var (
+		app      App
+		name     sql.NullString
+		enabled  sql.NullBool
+		settings sql.NullString
+	)
+
+	var id, key, secret string
+	if err := row.Scan(&id, &key, &secret, &name, &enabled, &settings); err != nil {
+		return nil, err
+	}
+
+	if settings.Valid && settings.String != "" {
+		if err := json.Unmarshal([]byte(settings.String), &app); err != nil {
+			return nil, fmt.Errorf("invalid settings of app %s: %w", id, err)
+		}
+	}
+
+	app.ID = id
+	app.Key = key
+	app.Secret = secret
+	app.Name = name.String
+	app.Enabled = enabled.Valid && enabled.Bool
+	return &app, nil
+}
+
+func (s *SQLStore) GetApp(ctx context.Context, key string) (*App, error) {
+	return s.lookup(ctx, s.byKey, "app_key", key)
+}
+
+func (s *SQLStore) GetAppByID(ctx context.Context, id string) (*App, error) {
+	return s.lookup(ctx, s.byID, "id", id)
+}
+
+func (s *SQLStore) lookup(ctx context.Context, cache map[string]cacheEntry, column, value string) (*App, error) {
+	now := time.Now()
+
+	s.cacheMux.Lock()
+	cached, hasCached := cache[value]
+	s.cacheMux.Unlock()
+
+	if hasCached && now.Before(cached.expires) {
+		if cached.disabled {
+			return nil, ErrAppDisabled
+		}
+		if cached.app == nil {
+			return nil, ErrAppNotFound
+		}
+		return cached.app, nil
+	}
+
+	app, err := scanApp(s.db.QueryRowContext(ctx, s.selectQuery(column), value))
+	if errors.Is(err, sql.ErrNoRows) {
+		s.cacheMissing(cache, value, false, now)
+		return nil, ErrAppNotFound
+	}
+	if err == nil && !app.Enabled {
+		s.cacheMissing(cache, value, true, now)
+		return nil, ErrAppDisabled
+	}
+	if err != nil {
+		// keep serving the last known app rather than dropping its connections
+		if hasCached && cached.app != nil {
+			log.Warn("app store unavailable, serving cached app", column, value, "error", err)
+			return cached.app, nil
+		}
+		return nil, err
+	}
+
+	s.cacheApp(app, now)
+	return app, nil
+}
+
+func (s *SQLStore) cacheApp(app *App, now time.Time) {
+	entry := cacheEntry{app: app, expires: now.Add(s.ttl)}
+
+	s.cacheMux.Lock()
+	defer s.cacheMux.Unlock()
+	s.byKey[app.Key] = entry
+	s.byID[app.ID] = entry
+}
+
+func (s *SQLStore) cacheMissing(cache map[string]cacheEntry, value string, disabled bool, now time.Time) {
+	s.cacheMux.Lock()
+	defer s.cacheMux.Unlock()
+
+	if len(cache) >= maxCacheEntries {
+		for k, entry := range cache {
+			if now.After(entry.expires) {
+				delete(cache, k)
+			}
+		}
+		if len(cache) >= maxCacheEntries {
+			return
+		}
+	}
+	cache[value] = cacheEntry{disabled: disabled, expires: now.Add(s.negTTL)}
+}
+
+// GetAllApps always queries the database and refreshes the cache with the result
+func (s *SQLStore) GetAllApps(ctx context.Context) ([]*App, error) {
+	all, err := s.ListApps(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	apps := make([]*App, 0, len(all))
+	for _, app := range all {
+		if app.Enabled {
+			s.cacheApp(app, now)
+			apps = append(apps, app)
+		}
+	}
+	return apps, nil
+}
+
+func (s *SQLStore) ListApps(ctx context.Context) ([]*App, error) {
+	rows, err := s.db.QueryContext(ctx, s.selectQuery(""))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	apps := []*App{}
+	for rows.Next() {
+		app, err := scanApp(rows)
+		if err != nil {
+			return nil, err
+		}
+		apps = append(apps, app)
+	}
+	return apps, rows.Err()
+}
+
+// settingsJSON encodes the properties of an app that have no column of their own
+func settingsJSON(app *App) (string, error) {
+	settings := *app
+	settings.ID = ""
+	settings.Key = ""
+	settings.Secret = ""
+	settings.Name = ""
+
+	data, err := json.Marshal(settings)
+	return string(data), err
+}
+
+func (s *SQLStore) CreateApp(ctx context.Context, app *App) error {
+	settings, err := settingsJSON(app)
+	if err != nil {
+		return err
+	}
+
+	var existing int
+	query := "SELECT COUNT(*) FROM " + s.table + " WHERE id = " + s.placeholder(1) + " OR app_key = " + s.placeholder(2)
+	if err := s.db.QueryRowContext(ctx, query, app.ID, app.Key).Scan(&existing); err != nil {
+		return err
+	}
+	if existing > 0 {
+		return ErrAppExists
+	}
+
+	query = "INSERT INTO " + s.table + " (id, app_key, secret, name, enabled, settings) VALUES (" +
+		s.placeholder(1) + ", " + s.placeholder(2) + ", " + s.placeholder(3) + ", " +
+		s.placeholder(4) + ", " + s.placeholder(5) + ", " + s.placeholder(6) + ")"
+	if _, err := s.db.ExecContext(ctx, query, app.ID, app.Key, app.Secret, app.Name, app.Enabled, settings); err != nil {
+		return err
+	}
+
+	s.invalidate(app.ID, app.Key)
+	return nil
+}
+
+func (s *SQLStore) UpdateApp(ctx context.Context, app *App) error {
+	settings, err := settingsJSON(app)
+	if err != nil {
+		return err
+	}
+
+	var previousKey string
+	query := "SELECT app_key FROM " + s.table + " WHERE id = " + s.placeholder(1)
+	if err := s.db.QueryRowContext(ctx, query, app.ID).Scan(&previousKey); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrAppNotFound
+		}
+		return err
+	}
+
+	var conflicts int
+	query = "SELECT COUNT(*) FROM " + s.table + " WHERE app_key = " + s.placeholder(1) + " AND id <> " + s.placeholder(2)
+	if err := s.db.QueryRowContext(ctx, query, app.Key, app.ID).Scan(&conflicts); err != nil {
+		return err
+	}
+	if conflicts > 0 {
+		return ErrAppExists
+	}
+
+	query = "UPDATE " + s.table + " SET app_key = " + s.placeholder(1) + ", secret = " + s.placeholder(2) +
+		", name = " + s.placeholder(3) + ", enabled = " + s.placeholder(4) + ", settings = " + s.placeholder(5) +
+		" WHERE id = " + s.placeholder(6)
+	if _, err := s.db.ExecContext(ctx, query, app.Key, app.Secret, app.Name, app.Enabled, settings, app.ID); err != nil {
+		return err
+	}
+
+	s.invalidate(app.ID, previousKey, app.Key)
+	return nil
+}
+
+func (s *SQLStore) DeleteApp(ctx context.Context, id string) error {
+	var key string
+	query := "SELECT app_key FROM " + s.table + " WHERE id = " + s.placeholder(1)
+	if err := s.db.QueryRowContext(ctx, query, id).Scan(&key); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrAppNotFound
+		}
+		return err
+	}
+
+	query = "DELETE FROM " + s.table + " WHERE id = " + s.placeholder(1)
+	if _, err := s.db.ExecContext(ctx, query, id); err != nil {
+		return err
+	}
+
+	s.invalidate(id, key)
+	return nil
+}
+
+// invalidate drops cached lookups after a write, other nodes pick the change
+// up once their cache expires
+func (s *SQLStore) invalidate(id string, keys ...string) {
+	s.cacheMux.Lock()
+	defer s.cacheMux.Unlock()
+
+	delete(s.byID, id)
+	for _, key := range keys {
+		delete(s.byKey, key)
+	}
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
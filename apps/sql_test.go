@@ -0,0 +1,178 @@
+package apps
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestSQLStore returns a store on a temporary sqlite database and a second
+// connection to it, standing in for another node writing to the table
+func newTestSQLStore(t *testing.T, ttl, negTTL time.Duration) (*SQLStore, *sql.DB) {
+	t.Helper()
+
+	dsn := filepath.Join(t.TempDir(), "apps.db")
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`CREATE TABLE apps (
+		id VARCHAR(255) PRIMARY KEY,
+		app_key VARCHAR(255) UNIQUE NOT NULL,
+		secret VARCHAR(255) NOT NULL,
+		name VARCHAR(255),
+		enabled BOOLEAN,
+		settings TEXT
+	)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSQLStore(SQLOptions{Driver: "sqlite", DSN: dsn, CacheTTL: ttl, NegativeCacheTTL: negTTL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s, db
+}
+
+func exec(t *testing.T, db *sql.DB, query string, args ...any) {
+	t.Helper()
+
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLStoreCachesApps(t *testing.T) {
+	s, db := newTestSQLStore(t, 200*time.Millisecond, time.Minute)
+	exec(t, db, `INSERT INTO apps VALUES ('1', 'key', 'secret', 'app', true, '{"max_connections":10}')`)
+
+	app, err := s.GetApp(t.Context(), "key")
+	if err != nil {
+		t.Fatalf("GetApp: %v", err)
+	}
+	if app.ID != "1" || app.Secret != "secret" || app.MaxConnections != 10 {
+		t.Errorf("app = %+v, want app 1 with its settings", app)
+	}
+
+	exec(t, db, `UPDATE apps SET secret = 'rotated'`)
+
+	for _, lookup := range []func() (*App, error){
+		func() (*App, error) { return s.GetApp(t.Context(), "key") },
+		func() (*App, error) { return s.GetAppByID(t.Context(), "1") },
+	} {
+		if app, err := lookup(); err != nil || app.Secret != "secret" {
+			t.Errorf("lookup before the ttl = %v, %v, want the cached secret", app, err)
+		}
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	if app, err := s.GetApp(t.Context(), "key"); err != nil || app.Secret != "rotated" {
+		t.Errorf("GetApp after the ttl = %v, %v, want the rotated secret", app, err)
+	}
+}
+
+func TestSQLStoreCachesMissingApps(t *testing.T) {
+	s, db := newTestSQLStore(t, time.Minute, 200*time.Millisecond)
+	exec(t, db, `INSERT INTO apps VALUES ('2', 'disabled', 'secret', 'app', false, '')`)
+
+	if _, err := s.GetApp(t.Context(), "key"); !errors.Is(err, ErrAppNotFound) {
+		t.Fatalf("GetApp of a missing app = %v, want ErrAppNotFound", err)
+	}
+	if _, err := s.GetApp(t.Context(), "disabled"); !errors.Is(err, ErrAppDisabled) {
+		t.Fatalf("GetApp of a disabled app = %v, want ErrAppDisabled", err)
+	}
+	if _, err := s.GetApp(t.Context(), "key"); errors.Is(err, ErrAppDisabled) {
+		t.Fatal("missing app reported as disabled")
+	}
+
+	exec(t, db, `INSERT INTO apps VALUES ('1', 'key', 'secret', 'app', true, '')`)
+	exec(t, db, `UPDATE apps SET enabled = true WHERE id = '2'`)
+
+	if _, err := s.GetApp(t.Context(), "key"); !errors.Is(err, ErrAppNotFound) {
+		t.Errorf("GetApp of a created app before the negative ttl = %v, want the cached ErrAppNotFound", err)
+	}
+	if _, err := s.GetApp(t.Context(), "disabled"); !errors.Is(err, ErrAppDisabled) {
+		t.Errorf("GetApp of a re-enabled app before the negative ttl = %v, want the cached ErrAppDisabled", err)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	for _, key := range []string{"key", "disabled"} {
+		if _, err := s.GetApp(t.Context(), key); err != nil {
+			t.Errorf("GetApp(%s) after the negative ttl = %v, want the app", key, err)
+		}
+	}
+}
+
+func TestSQLStoreServesCachedAppsWhileDown(t *testing.T) {
+	s, db := newTestSQLStore(t, 50*time.Millisecond, 50*time.Millisecond)
+	exec(t, db, `INSERT INTO apps VALUES ('1', 'key', 'secret', 'app', true, '')`)
+
+	if _, err := s.GetApp(t.Context(), "key"); err != nil {
+		t.Fatalf("GetApp: %v", err)
+	}
+
+	// every query fails from now on
+	exec(t, db, `ALTER TABLE apps RENAME TO apps_gone`)
+	time.Sleep(100 * time.Millisecond)
+
+	if app, err := s.GetApp(t.Context(), "key"); err != nil || app.ID != "1" {
+		t.Errorf("GetApp of an expired app = %v, %v, want the cached app", app, err)
+	}
+	if app, err := s.GetAppByID(t.Context(), "1"); err != nil || app.Key != "key" {
+		t.Errorf("GetAppByID of an expired app = %v, %v, want the cached app", app, err)
+	}
+
+	// an app that was never cached can't be told apart from a missing one
+	if _, err := s.GetApp(t.Context(), "other"); err == nil || errors.Is(err, ErrAppNotFound) {
+		t.Errorf("GetApp of an uncached app = %v, want the database error", err)
+	}
+}
+
+func TestSQLStoreInvalidatesOnWrite(t *testing.T) {
+	s, _ := newTestSQLStore(t, time.Minute, time.Minute)
+	ctx := t.Context()
+
+	// a cached miss must not hide the app once it is created
+	if _, err := s.GetApp(ctx, "key"); !errors.Is(err, ErrAppNotFound) {
+		t.Fatalf("GetApp = %v, want ErrAppNotFound", err)
+	}
+	if err := s.CreateApp(ctx, &App{ID: "1", Key: "key", Secret: "secret", Enabled: true}); err != nil {
+		t.Fatalf("CreateApp: %v", err)
+	}
+	if _, err := s.GetApp(ctx, "key"); err != nil {
+		t.Fatalf("GetApp after CreateApp = %v, want the app", err)
+	}
+
+	if err := s.UpdateApp(ctx, &App{ID: "1", Key: "new-key", Secret: "rotated", Enabled: true}); err != nil {
+		t.Fatalf("UpdateApp: %v", err)
+	}
+	if _, err := s.GetApp(ctx, "key"); !errors.Is(err, ErrAppNotFound) {
+		t.Errorf("GetApp of the previous key = %v, want ErrAppNotFound", err)
+	}
+	if app, err := s.GetApp(ctx, "new-key"); err != nil || app.Secret != "rotated" {
+		t.Errorf("GetApp of the new key = %v, %v, want the rotated secret", app, err)
+	}
+	if app, err := s.GetAppByID(ctx, "1"); err != nil || app.Secret != "rotated" {
+		t.Errorf("GetAppByID = %v, %v, want the rotated secret", app, err)
+	}
+
+	if err := s.DeleteApp(ctx, "1"); err != nil {
+		t.Fatalf("DeleteApp: %v", err)
+	}
+	if _, err := s.GetAppByID(ctx, "1"); !errors.Is(err, ErrAppNotFound) {
+		t.Errorf("GetAppByID after DeleteApp = %v, want ErrAppNotFound", err)
+	}
+	if _, err := s.GetApp(ctx, "new-key"); !errors.Is(err, ErrAppNotFound) {
+		t.Errorf("GetApp after DeleteApp = %v, want ErrAppNotFound", err)
+	}
+}
@@ -0,0 +1,285 @@
+package apps
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+var (
+	ErrAppNotFound = errors.New("app not found")
+	// ErrAppDisabled matches ErrAppNotFound too, callers that don't tell
+	// them apart treat a disabled app as missing
+	ErrAppDisabled   = fmt.Errorf("%w: app is disabled", ErrAppNotFound)
+	ErrAppExists     = errors.New("app id or key already in use")
+	ErrReadOnlyStore = errors.New("app store is read only")
+)
+
+// AppStore is a source of apps. Lookups only return enabled apps, they
+// report ErrAppDisabled for disabled apps and ErrAppNotFound otherwise.
+type AppStore interface {
+	GetApp(ctx context.Context, key string) (*App, error)
+	GetAppByID(ctx context.Context, id string) (*App, error)
+	GetAllApps(ctx context.Context) ([]*App, error)
+	Close() error
+}
+
+// WritableStore is implemented by stores whose apps can be changed at runtime
+type WritableStore interface {
+	AppStore
+	// ListApps returns every app, including disabled ones
+	ListApps(ctx context.Context) ([]*App, error)
+	CreateApp(ctx context.Context, app *App) error
+	// UpdateApp replaces the app with the same id
+	UpdateApp(ctx context.Context, app *App) error
+	DeleteApp(ctx context.Context, id string) error
+}
+
+// FileStore holds the apps of a JSON config file in memory
+type FileStore struct {
+	list     []*App          // every app in file order, including disabled ones
+	apps     map[string]*App // key -> enabled app
+	appsById map[string]*App // id -> enabled app
+	mu       sync.RWMutex
+}
+
+func NewFileStore() *FileStore {
+	return &FileStore{
+		apps:     make(map[string]*App),
+		appsById: make(map[string]*App),
+	}
+}
+
+// ReadConfig parses a config file without loading its apps anywhere
+func ReadConfig(filename string) (*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read apps config: %w", err)
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse apps config: %w", err)
+	}
+	return &config, nil
+}
+
+// WriteApps replaces the apps of a config file, leaving its other sections as
+// they are. The file is replaced atomically so watchers never read it half written.
+func WriteApps(filename string, apps []*App) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read apps config: %w", err)
+	}
+
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return fmt.Errorf("failed to parse apps config: %w", err)
+	}
+
+	encodedApps, err := json.Marshal(apps)
+	if err != nil {
+		return err
+	}
+	sections["apps"] = encodedApps
+
+	data, err = json.MarshalIndent(sections, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write apps config: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write apps config: %w", err)
+	}
+	if err := tmp.Chmod(info.Mode()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// Load replaces the apps of the store with the apps of a config file
+func (s *FileStore) Load(filename string) (*Config, error) {
+	config, err := ReadConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	s.SetApps(config.Apps)
+	return config, nil
+}
+
+func (s *FileStore) SetApps(apps []App) {
+	list := make([]*App, len(apps))
+	for i := range apps {
+		list[i] = &apps[i]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.list = list
+	s.reindex()
+}
+
+// reindex rebuilds the lookups of enabled apps, must be called with s.mu held
+func (s *FileStore) reindex() {
+	s.apps = make(map[string]*App, len(s.list))
+	s.appsById = make(map[string]*App, len(s.list))
+
+	for _, app := range s.list {
+		if app.Enabled {
+			s.apps[app.Key] = app
+			s.appsById[app.ID] = app
+		}
+	}
+}
+
+// find returns the index of the app with the given id, must be called with s.mu held
+func (s *FileStore) find(id string) int {
+	return slices.IndexFunc(s.list, func(app *App) bool { return app.ID == id })
+}
+
+// keyTaken reports whether another app uses the key or one of the additional
+// keys of app, must be called with s.mu held
+func (s *FileStore) keyTaken(app *App) bool {
+	return slices.ContainsFunc(s.list, func(other *App) bool {
+		if other.ID == app.ID {
+			return false
+		}
+		if other.HasKey(app.Key) {
+			return true
+		}
+		return slices.ContainsFunc(app.Keys, func(k AppKey) bool { return other.HasKey(k.Key) })
+	})
+}
+
+func (s *FileStore) GetApp(ctx context.Context, key string) (*App, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if app, exists := s.apps[key]; exists {
+		return app, nil
+	}
+	return nil, s.missing(func(app *App) bool { return app.Key == key })
+}
+
+func (s *FileStore) GetAppByID(ctx context.Context, id string) (*App, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if app, exists := s.appsById[id]; exists {
+		return app, nil
+	}
+	return nil, s.missing(func(app *App) bool { return app.ID == id })
+}
+
+// missing returns the error of a failed lookup, must be called with s.mu held
+func (s *FileStore) missing(match func(app *App) bool) error {
+	if slices.ContainsFunc(s.list, match) {
+		return ErrAppDisabled
+	}
+	return ErrAppNotFound
+}
+
+func (s *FileStore) GetAllApps(ctx context.Context) ([]*App, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	apps := make([]*App, 0, len(s.apps))
+	for _, app := range s.list {
+		if app.Enabled {
+			apps = append(apps, app)
+		}
+	}
+	return apps, nil
+}
+
+func (s *FileStore) ListApps(ctx context.Context) ([]*App, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.list), nil
+}
+
+func (s *FileStore) CreateApp(ctx context.Context, app *App) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.find(app.ID) >= 0 || s.keyTaken(app) {
+		return ErrAppExists
+	}
+	s.list = append(s.list, app)
+	s.reindex()
+	return nil
+}
+
+func (s *FileStore) UpdateApp(ctx context.Context, app *App) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.find(app.ID)
+	if i < 0 {
+		return ErrAppNotFound
+	}
+	if s.keyTaken(app) {
+		return ErrAppExists
+	}
+	s.list[i] = app
+	s.reindex()
+	return nil
+}
+
+func (s *FileStore) DeleteApp(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.find(id)
+	if i < 0 {
+		return ErrAppNotFound
+	}
+	s.list = slices.Delete(s.list, i, i+1)
+	s.reindex()
+	return nil
+}
+
+// AddApp adds or replaces the app with the same id
+func (s *FileStore) AddApp(app *App) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i := s.find(app.ID); i >= 0 {
+		s.list[i] = app
+	} else {
+		s.list = append(s.list, app)
+	}
+	s.reindex()
+}
+
+func (s *FileStore) RemoveApp(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.list = slices.DeleteFunc(s.list, func(app *App) bool { return app.Key == key })
+	s.reindex()
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
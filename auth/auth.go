@@ -13,31 +13,75 @@ import (
 	"time"
 )
 
+// Service signs with the first secret of the app key and accepts signatures
+// made with any secret of the app key or of its additional keys, so secrets
+// can be rotated without downtime
 type Service struct {
-	appKey    string
-	appSecret string
+	appKey  string
+	secrets map[string][]string // key -> accepted secrets
 }
 
-func NewService(appKey, appSecret string) *Service {
+func NewService(appKey string, appSecrets ...string) *Service {
 	return &Service{
-		appKey:    appKey,
-		appSecret: appSecret,
+		appKey:  appKey,
+		secrets: map[string][]string{appKey: appSecrets},
 	}
 }
 
-func (s *Service) GenerateSignature(socketID, channel string, channelData *string) string {
-	var stringToSign string
-	if channelData != nil {
-		stringToSign = fmt.Sprintf("%s:%s:%s", socketID, channel, *channelData)
-	} else {
-		stringToSign = fmt.Sprintf("%s:%s", socketID, channel)
-	}
+// AddKey accepts signatures made with an additional key of the app,
+// signatures generated by the service keep using the app key
+func (s *Service) AddKey(key string, secrets ...string) {
+	s.secrets[key] = secrets
+}
 
-	h := hmac.New(sha256.New, []byte(s.appSecret))
+func sign(secret, stringToSign string) string {
+	h := hmac.New(sha256.New, []byte(secret))
 	h.Write([]byte(stringToSign))
-	signature := hex.EncodeToString(h.Sum(nil))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// primary returns the secret used to generate signatures
+func (s *Service) primary() string {
+	if secrets := s.secrets[s.appKey]; len(secrets) > 0 {
+		return secrets[0]
+	}
+	return ""
+}
+
+// verify reports whether signature signs stringToSign with any secret of key
+func (s *Service) verify(key, signature, stringToSign string) bool {
+	for _, secret := range s.secrets[key] {
+		if hmac.Equal([]byte(signature), []byte(sign(secret, stringToSign))) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAuthString checks an "app_key:signature" auth string and returns why it is invalid
+func (s *Service) checkAuthString(authString, stringToSign string) error {
+	key, signature, err := ParseAuthString(authString)
+	if err != nil {
+		return err
+	}
+	if _, known := s.secrets[key]; !known {
+		return fmt.Errorf("unknown auth key %q", key)
+	}
+	if !s.verify(key, signature, stringToSign) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+func channelStringToSign(socketID, channel string, channelData *string) string {
+	if channelData != nil {
+		return fmt.Sprintf("%s:%s:%s", socketID, channel, *channelData)
+	}
+	return fmt.Sprintf("%s:%s", socketID, channel)
+}
 
-	return signature
+func (s *Service) GenerateSignature(socketID, channel string, channelData *string) string {
+	return sign(s.primary(), channelStringToSign(socketID, channel, channelData))
 }
 
 func (s *Service) GenerateAuthString(socketID, channel string, channelData *string) string {
@@ -46,8 +90,31 @@ func (s *Service) GenerateAuthString(socketID, channel string, channelData *stri
 }
 
 func (s *Service) ValidateAuth(authString, socketID, channel string, channelData *string) bool {
-	expectedAuth := s.GenerateAuthString(socketID, channel, channelData)
-	return hmac.Equal([]byte(authString), []byte(expectedAuth))
+	return s.CheckAuth(authString, socketID, channel, channelData) == nil
+}
+
+// CheckAuth is ValidateAuth reporting why the auth string was rejected
+func (s *Service) CheckAuth(authString, socketID, channel string, channelData *string) error {
+	return s.checkAuthString(authString, channelStringToSign(socketID, channel, channelData))
+}
+
+func userStringToSign(socketID, userData string) string {
+	return fmt.Sprintf("%s::user::%s", socketID, userData)
+}
+
+// GenerateUserSignature signs user authentication data, see
+// https://pusher.com/docs/channels/library_auth_reference/auth-signatures/#user-authentication
+func (s *Service) GenerateUserSignature(socketID, userData string) string {
+	return sign(s.primary(), userStringToSign(socketID, userData))
+}
+
+func (s *Service) ValidateUserAuth(authString, socketID, userData string) bool {
+	return s.CheckUserAuth(authString, socketID, userData) == nil
+}
+
+// CheckUserAuth is ValidateUserAuth reporting why the auth string was rejected
+func (s *Service) CheckUserAuth(authString, socketID, userData string) error {
+	return s.checkAuthString(authString, userStringToSign(socketID, userData))
 }
 
 func ParseAuthString(authString string) (appKey, signature string, err error) {
@@ -78,7 +145,7 @@ func (s *Service) ValidateHTTPRequest(method, path string, queryParams url.Value
 		return fmt.Errorf("missing auth_signature")
 	}
 
-	if authKey != s.appKey {
+	if _, known := s.secrets[authKey]; !known {
 		return fmt.Errorf("invalid auth_key")
 	}
 
@@ -105,9 +172,7 @@ func (s *Service) ValidateHTTPRequest(method, path string, queryParams url.Value
 		}
 	}
 
-	expectedSignature := s.GenerateHTTPSignature(method, path, queryParams)
-
-	if !hmac.Equal([]byte(authSignature), []byte(expectedSignature)) {
+	if !s.verify(authKey, authSignature, httpStringToSign(method, path, queryParams)) {
 		return fmt.Errorf("invalid auth_signature")
 	}
 
@@ -115,6 +180,10 @@ func (s *Service) ValidateHTTPRequest(method, path string, queryParams url.Value
 }
 
 func (s *Service) GenerateHTTPSignature(method, path string, queryParams url.Values) string {
+	return sign(s.primary(), httpStringToSign(method, path, queryParams))
+}
+
+func httpStringToSign(method, path string, queryParams url.Values) string {
 	params := url.Values{}
 	for k, v := range queryParams {
 		if k != "auth_signature" {
@@ -136,11 +205,5 @@ func (s *Service) GenerateHTTPSignature(method, path string, queryParams url.Val
 	}
 	queryString := strings.Join(queryParts, "&")
 
-	stringToSign := fmt.Sprintf("%s\n%s\n%s", strings.ToUpper(method), path, queryString)
-
-	h := hmac.New(sha256.New, []byte(s.appSecret))
-	h.Write([]byte(stringToSign))
-	signature := hex.EncodeToString(h.Sum(nil))
-
-	return signature
+	return fmt.Sprintf("%s\n%s\n%s", strings.ToUpper(method), path, queryString)
 }
@@ -3,75 +3,110 @@ package channel
 import (
 	"fmt"
 	"sync"
+
+	"github.com/aelpxy/pulse/metrics"
 )
 
 type Channel struct {
 	Name        string
+	AppID       string
 	subscribers map[string]bool
 	mux         sync.RWMutex
 }
 
 type Manager struct {
-	channels map[string]*Channel
-	mux      sync.RWMutex
+	apps map[string]map[string]*Channel // app id -> channel name -> channel
+	mux  sync.RWMutex
 }
 
 func NewManager() *Manager {
 	return &Manager{
-		channels: make(map[string]*Channel),
+		apps: make(map[string]map[string]*Channel),
 	}
 }
 
-func (m *Manager) Subscribe(channelName, connID string) error {
+// lookup must be called with m.mux held
+func (m *Manager) lookup(appID, channelName string) (*Channel, bool) {
+	channels, exists := m.apps[appID]
+	if !exists {
+		return nil, false
+	}
+	channel, exists := channels[channelName]
+	return channel, exists
+}
+
+// Subscribe adds connID to the channel and reports whether the channel became occupied
+func (m *Manager) Subscribe(appID, channelName, connID string) (bool, error) {
 	m.mux.Lock()
 	defer m.mux.Unlock()
 
-	channel, exists := m.channels[channelName]
+	channels, exists := m.apps[appID]
+	if !exists {
+		channels = make(map[string]*Channel)
+		m.apps[appID] = channels
+	}
+
+	channel, exists := channels[channelName]
 	if !exists {
 		channel = &Channel{
 			Name:        channelName,
+			AppID:       appID,
 			subscribers: make(map[string]bool),
 		}
-		m.channels[channelName] = channel
+		channels[channelName] = channel
+		metrics.ChannelsActive.Inc()
 	}
 
 	channel.mux.Lock()
+	occupied := len(channel.subscribers) == 0
 	channel.subscribers[connID] = true
 	channel.mux.Unlock()
 
-	return nil
+	return occupied, nil
 }
 
-func (m *Manager) Unsubscribe(channelName, connID string) {
+// Unsubscribe removes connID from the channel and reports whether the channel was vacated
+func (m *Manager) Unsubscribe(appID, channelName, connID string) bool {
 	m.mux.RLock()
-	channel, exists := m.channels[channelName]
+	channel, exists := m.lookup(appID, channelName)
 	m.mux.RUnlock()
 
 	if !exists {
-		return
+		return false
 	}
 
 	channel.mux.Lock()
+	_, subscribed := channel.subscribers[connID]
 	delete(channel.subscribers, connID)
 	isEmpty := len(channel.subscribers) == 0
 	channel.mux.Unlock()
 
-	if isEmpty {
-		m.mux.Lock()
-		if ch, exists := m.channels[channelName]; exists {
-			ch.mux.Lock()
-			if len(ch.subscribers) == 0 {
-				delete(m.channels, channelName)
+	if !subscribed || !isEmpty {
+		return false
+	}
+
+	vacated := false
+	m.mux.Lock()
+	if ch, exists := m.lookup(appID, channelName); exists {
+		ch.mux.Lock()
+		if len(ch.subscribers) == 0 {
+			delete(m.apps[appID], channelName)
+			if len(m.apps[appID]) == 0 {
+				delete(m.apps, appID)
 			}
-			ch.mux.Unlock()
+			vacated = true
+			metrics.ChannelsActive.Dec()
 		}
-		m.mux.Unlock()
+		ch.mux.Unlock()
 	}
+	m.mux.Unlock()
+
+	return vacated
 }
 
-func (m *Manager) GetSubscribers(channelName string) []string {
+func (m *Manager) GetSubscribers(appID, channelName string) []string {
 	m.mux.RLock()
-	channel, exists := m.channels[channelName]
+	channel, exists := m.lookup(appID, channelName)
 	m.mux.RUnlock()
 
 	if !exists {
@@ -89,11 +124,11 @@ func (m *Manager) GetSubscribers(channelName string) []string {
 	return subscribers
 }
 
-func (m *Manager) GetChannel(channelName string) (*Channel, error) {
+func (m *Manager) GetChannel(appID, channelName string) (*Channel, error) {
 	m.mux.RLock()
 	defer m.mux.RUnlock()
 
-	channel, exists := m.channels[channelName]
+	channel, exists := m.lookup(appID, channelName)
 	if !exists {
 		return nil, fmt.Errorf("channel not found: %s", channelName)
 	}
@@ -101,15 +136,27 @@ func (m *Manager) GetChannel(channelName string) (*Channel, error) {
 	return channel, nil
 }
 
+// GetChannelCount returns the number of active channels across all apps
 func (m *Manager) GetChannelCount() int {
 	m.mux.RLock()
 	defer m.mux.RUnlock()
-	return len(m.channels)
+
+	count := 0
+	for _, channels := range m.apps {
+		count += len(channels)
+	}
+	return count
+}
+
+func (m *Manager) GetAppChannelCount(appID string) int {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	return len(m.apps[appID])
 }
 
-func (m *Manager) GetSubscriberCount(channelName string) int {
+func (m *Manager) GetSubscriberCount(appID, channelName string) int {
 	m.mux.RLock()
-	channel, exists := m.channels[channelName]
+	channel, exists := m.lookup(appID, channelName)
 	m.mux.RUnlock()
 
 	if !exists {
@@ -120,3 +167,23 @@ func (m *Manager) GetSubscriberCount(channelName string) int {
 	defer channel.mux.RUnlock()
 	return len(channel.subscribers)
 }
+
+// GetChannels returns the active channels of an app with their subscriber counts
+func (m *Manager) GetChannels(appID string) map[string]int {
+	m.mux.RLock()
+	channels := make([]*Channel, 0, len(m.apps[appID]))
+	for _, channel := range m.apps[appID] {
+		channels = append(channels, channel)
+	}
+	m.mux.RUnlock()
+
+	result := make(map[string]int, len(channels))
+	for _, channel := range channels {
+		channel.mux.RLock()
+		if count := len(channel.subscribers); count > 0 {
+			result[channel.Name] = count
+		}
+		channel.mux.RUnlock()
+	}
+	return result
+}
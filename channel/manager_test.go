@@ -0,0 +1,72 @@
+package channel
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestManagerIsolatesApps(t *testing.T) {
+	m := NewManager()
+
+	if occupied, _ := m.Subscribe("app-a", "presence-lobby", "a.1"); !occupied {
+		t.Fatal("first subscriber of app-a did not occupy the channel")
+	}
+	m.Subscribe("app-a", "presence-lobby", "a.2")
+	if occupied, _ := m.Subscribe("app-b", "presence-lobby", "b.1"); !occupied {
+		t.Fatal("first subscriber of app-b did not occupy the channel, it shares app-a's")
+	}
+
+	subscribers := m.GetSubscribers("app-a", "presence-lobby")
+	slices.Sort(subscribers)
+	if !slices.Equal(subscribers, []string{"a.1", "a.2"}) {
+		t.Errorf("app-a subscribers = %v, want [a.1 a.2]", subscribers)
+	}
+	if subscribers := m.GetSubscribers("app-b", "presence-lobby"); !slices.Equal(subscribers, []string{"b.1"}) {
+		t.Errorf("app-b subscribers = %v, want [b.1]", subscribers)
+	}
+
+	if count := m.GetSubscriberCount("app-a", "presence-lobby"); count != 2 {
+		t.Errorf("app-a subscriber count = %d, want 2", count)
+	}
+	if count := m.GetSubscriberCount("app-b", "presence-lobby"); count != 1 {
+		t.Errorf("app-b subscriber count = %d, want 1", count)
+	}
+
+	m.Subscribe("app-a", "private-orders", "a.1")
+	if channels := m.GetChannels("app-a"); len(channels) != 2 || channels["presence-lobby"] != 2 || channels["private-orders"] != 1 {
+		t.Errorf("app-a channels = %v, want presence-lobby:2 private-orders:1", channels)
+	}
+	if channels := m.GetChannels("app-b"); len(channels) != 1 || channels["presence-lobby"] != 1 {
+		t.Errorf("app-b channels = %v, want presence-lobby:1", channels)
+	}
+	if count := m.GetChannelCount(); count != 3 {
+		t.Errorf("channel count = %d, want 3", count)
+	}
+}
+
+func TestManagerVacatesPerApp(t *testing.T) {
+	m := NewManager()
+	m.Subscribe("app-a", "lobby", "a.1")
+	m.Subscribe("app-b", "lobby", "b.1")
+
+	// a connection id of another app must not remove anything
+	if vacated := m.Unsubscribe("app-a", "lobby", "b.1"); vacated {
+		t.Fatal("unsubscribing app-b's connection vacated app-a's channel")
+	}
+	if count := m.GetSubscriberCount("app-a", "lobby"); count != 1 {
+		t.Fatalf("app-a subscriber count = %d, want 1", count)
+	}
+
+	if vacated := m.Unsubscribe("app-a", "lobby", "a.1"); !vacated {
+		t.Fatal("last subscriber of app-a did not vacate the channel")
+	}
+	if channels := m.GetChannels("app-a"); len(channels) != 0 {
+		t.Errorf("app-a channels = %v, want none", channels)
+	}
+	if count := m.GetSubscriberCount("app-b", "lobby"); count != 1 {
+		t.Errorf("app-b subscriber count = %d after app-a vacated, want 1", count)
+	}
+	if count := m.GetAppChannelCount("app-b"); count != 1 {
+		t.Errorf("app-b channel count = %d, want 1", count)
+	}
+}
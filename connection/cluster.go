@@ -0,0 +1,164 @@
+package connection
+
+import (
+	"context"
+	"time"
+
+	"github.com/aelpxy/pulse/adapter"
+	"github.com/aelpxy/pulse/tracing"
+	"github.com/aelpxy/pulse/webhook"
+	"github.com/charmbracelet/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const adapterTimeout = 5 * time.Second
+
+// SetAdapter connects the manager to the other nodes of the cluster, it
+// replaces the memory adapter and must be called before clients connect
+func (m *Manager) SetAdapter(a adapter.Adapter) error {
+	if err := a.Start(m.handleRemote, m); err != nil {
+		return err
+	}
+	m.adapter = a
+	return nil
+}
+
+// LocalChannels implements adapter.LocalState
+func (m *Manager) LocalChannels(appID string) map[string]int {
+	return m.channelManager.GetChannels(appID)
+}
+
+// LocalSubscriptionCount implements adapter.LocalState
+func (m *Manager) LocalSubscriptionCount(appID, channelName string) int {
+	return m.channelManager.GetSubscriberCount(appID, channelName)
+}
+
+// GetChannels returns the subscription count of every occupied channel of an
+// app across the cluster. On error the counts of the nodes that replied are
+// returned, they are lower than the real ones.
+func (m *Manager) GetChannels(ctx context.Context, appID string) (map[string]int, error) {
+	return m.adapter.Channels(ctx, appID)
+}
+
+func (m *Manager) GetSubscriptionCount(ctx context.Context, appID, channelName string) (int, error) {
+	return m.adapter.SubscriptionCount(ctx, appID, channelName)
+}
+
+func (m *Manager) handleRemote(msg *adapter.Message) {
+	switch msg.Type {
+	case adapter.TypeChannel:
+		_, span := m.startRemoteSpan(msg, attribute.String("pulse.channel", msg.Channel))
+		delivered := m.broadcastLocal(msg.AppID, msg.Channel, msg.Payload, msg.ExcludeSocketID, fromUnixNano(msg.Ingress))
+		span.SetAttributes(attribute.Int("pulse.subscribers", delivered))
+		span.End()
+	case adapter.TypeUser:
+		_, span := m.startRemoteSpan(msg, attribute.String("pulse.user_id", msg.UserID))
+		delivered := m.sendToUserLocal(msg.AppID, msg.UserID, msg.Payload, fromUnixNano(msg.Ingress))
+		span.SetAttributes(attribute.Int("pulse.connections", delivered))
+		span.End()
+	case adapter.TypeTerminateUser:
+		m.terminateUserLocal(msg.AppID, msg.UserID)
+	case adapter.TypeChannelOccupied:
+		m.fireWebhook(msg.AppID, webhook.Event{Name: webhook.EventChannelOccupied, Channel: msg.Channel})
+	case adapter.TypeChannelVacated:
+		m.fireWebhook(msg.AppID, webhook.Event{Name: webhook.EventChannelVacated, Channel: msg.Channel})
+	}
+}
+
+// startRemoteSpan continues the trace of the node that published msg
+func (m *Manager) startRemoteSpan(msg *adapter.Message, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx := tracing.Extract(context.Background(), propagation.MapCarrier(msg.Trace))
+	attrs = append(attrs, attribute.String("pulse.app_id", msg.AppID), attribute.String("pulse.node_id", msg.NodeID))
+	return tracing.StartChild(ctx, "pulse.broadcast.remote", attrs...)
+}
+
+// publishRemote forwards msg to the other nodes, along with the trace context of ctx
+func (m *Manager) publishRemote(ctx context.Context, msg *adapter.Message) {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		carrier := propagation.MapCarrier{}
+		tracing.Inject(ctx, carrier)
+		msg.Trace = carrier
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), adapterTimeout)
+	defer cancel()
+
+	if err := m.adapter.Publish(ctx, msg); err != nil {
+		log.Warn("failed to publish to cluster", "type", msg.Type, "app", msg.AppID, "channel", msg.Channel, "error", err)
+	}
+}
+
+// syncInterest subscribes this node to a channel's cluster traffic while it
+// has local subscribers. Reading the current state under the channel's lock
+// keeps racing occupied and vacated transitions from leaving a stale
+// subscription, while other channels don't wait on the adapter round trip.
+//
+// The adapter reports whether the channel became occupied or vacated across
+// the cluster, so the webhooks fire once however many nodes have subscribers.
+func (m *Manager) syncInterest(appID, channelName string) {
+	unlock := m.lockInterest(channelKey{appID, channelName})
+
+	ctx, cancel := context.WithTimeout(context.Background(), adapterTimeout)
+	defer cancel()
+
+	event := webhook.EventChannelOccupied
+	var changed bool
+	var err error
+	if m.channelManager.GetSubscriberCount(appID, channelName) > 0 {
+		changed, err = m.adapter.Subscribe(ctx, appID, channelName)
+	} else {
+		event = webhook.EventChannelVacated
+		changed, err = m.adapter.Unsubscribe(ctx, appID, channelName)
+	}
+	unlock()
+
+	if err != nil {
+		log.Warn("failed to update cluster subscription", "app", appID, "channel", channelName, "error", err)
+		return
+	}
+	if changed {
+		m.fireWebhook(appID, webhook.Event{Name: event, Channel: channelName})
+	}
+}
+
+// lockInterest locks the interest of a channel and returns its unlock
+// function, the lock is dropped once nobody holds or waits for it
+func (m *Manager) lockInterest(key channelKey) func() {
+	m.interestMux.Lock()
+	l, exists := m.interestLocks[key]
+	if !exists {
+		l = &interestLock{}
+		m.interestLocks[key] = l
+	}
+	l.refs++
+	m.interestMux.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+
+		m.interestMux.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(m.interestLocks, key)
+		}
+		m.interestMux.Unlock()
+	}
+}
+
+// unixNano encodes an ingress time for other nodes, the zero time stays 0
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
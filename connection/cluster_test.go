@@ -0,0 +1,159 @@
+package connection
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aelpxy/pulse/adapter"
+	"github.com/aelpxy/pulse/apps"
+	"github.com/aelpxy/pulse/protocol"
+	"github.com/aelpxy/pulse/webhook"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// webhookLog records the events posted to a webhook endpoint
+type webhookLog struct {
+	mu     sync.Mutex
+	events []webhook.Event
+}
+
+func newWebhookLog(t *testing.T) (*webhookLog, string) {
+	t.Helper()
+
+	l := &webhookLog{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhook.Payload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("invalid webhook payload: %v", err)
+		}
+		l.mu.Lock()
+		l.events = append(l.events, payload.Events...)
+		l.mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	return l, server.URL
+}
+
+// count returns how often name was posted, after giving pending batches time to arrive
+func (l *webhookLog) count(name string) int {
+	time.Sleep(time.Second)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count := 0
+	for _, event := range l.events {
+		if event.Name == name {
+			count++
+		}
+	}
+	return count
+}
+
+// newClusterNode returns a manager joined to the cluster in mr and the URL
+// its websocket endpoint listens on
+func newClusterNode(t *testing.T, mr *miniredis.Miniredis, app *apps.App) (*Manager, string) {
+	t.Helper()
+
+	// created first so it is closed after the manager shut down
+	a := adapter.NewRedisFromClient(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "pulse:")
+	t.Cleanup(func() { a.Close() })
+
+	m, url := newTestManager(t, app)
+	if err := m.SetAdapter(a); err != nil {
+		t.Fatalf("SetAdapter: %v", err)
+	}
+
+	dispatcher := webhook.NewDispatcher(nil)
+	t.Cleanup(func() { dispatcher.Shutdown(5 * time.Second) })
+	m.SetWebhookDispatcher(dispatcher)
+
+	return m, url
+}
+
+func TestClusterPublish(t *testing.T) {
+	mr := miniredis.RunT(t)
+	hooks, hookURL := newWebhookLog(t)
+	app := testApp("app")
+	app.Webhooks = []apps.Webhook{{URL: hookURL}}
+
+	nodeA, urlA := newClusterNode(t, mr, app)
+	nodeB, urlB := newClusterNode(t, mr, app)
+
+	alice := dial(t, urlA, app)
+	alice.subscribe("lobby", nil)
+	bob := dial(t, urlB, app)
+	bob.subscribe("lobby", nil)
+	carol := dial(t, urlB, app)
+	carol.subscribe("lobby", nil)
+
+	// the way the HTTP API publishes an event
+	nodeA.PublishToChannel(t.Context(), app.ID, "lobby", "order-placed", `{"id":1}`, "", time.Now())
+
+	alice.expect("order-placed", "lobby")
+	if msg := bob.expect("order-placed", "lobby"); msg.Data != `{"id":1}` {
+		t.Errorf("node b received data %q", msg.Data)
+	}
+	carol.expect("order-placed", "lobby")
+
+	if channels, err := nodeA.GetChannels(t.Context(), app.ID); err != nil || len(channels) != 1 || channels["lobby"] != 3 {
+		t.Errorf("node a channels = %v, %v, want lobby:3 summed over both nodes", channels, err)
+	}
+	if count, err := nodeB.GetSubscriptionCount(t.Context(), app.ID, "lobby"); err != nil || count != 3 {
+		t.Errorf("node b subscription count = %d, %v, want 3", count, err)
+	}
+
+	if count := hooks.count(webhook.EventChannelOccupied); count != 1 {
+		t.Errorf("channel_occupied sent %d times, want once for the cluster", count)
+	}
+
+	alice.ws.Close()
+	bob.ws.Close()
+	carol.ws.Close()
+
+	if count := hooks.count(webhook.EventChannelVacated); count != 1 {
+		t.Errorf("channel_vacated sent %d times, want once for the cluster", count)
+	}
+}
+
+// stallingAdapter holds subscriptions to one channel until released
+type stallingAdapter struct {
+	*adapter.Memory
+	channel string
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func (a *stallingAdapter) Subscribe(ctx context.Context, appID, channel string) (bool, error) {
+	if channel == a.channel {
+		close(a.stalled)
+		<-a.release
+	}
+	return a.Memory.Subscribe(ctx, appID, channel)
+}
+
+func TestSlowClusterSubscribeDoesNotBlockOtherChannels(t *testing.T) {
+	app := testApp("app")
+	m, url := newTestManager(t, app)
+
+	stalling := &stallingAdapter{Memory: adapter.NewMemory(), channel: "slow", stalled: make(chan struct{}), release: make(chan struct{})}
+	if err := m.SetAdapter(stalling); err != nil {
+		t.Fatal(err)
+	}
+	defer close(stalling.release)
+
+	alice := dial(t, url, app)
+	alice.send(protocol.EventSubscribe, map[string]any{"channel": "slow"})
+	<-stalling.stalled
+
+	// waits for alice's round trip when the lock is shared between channels
+	bob := dial(t, url, app)
+	bob.subscribe("fast", nil)
+}
@@ -2,13 +2,16 @@ package connection
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/aelpxy/pulse/apps"
+	"github.com/aelpxy/pulse/metrics"
 	"github.com/aelpxy/pulse/protocol"
+	"github.com/aelpxy/pulse/webhook"
 	"github.com/charmbracelet/log"
 	"github.com/gorilla/websocket"
 	"golang.org/x/time/rate"
@@ -20,11 +23,23 @@ var bufferPool = sync.Pool{
 	},
 }
 
+// outbound is a frame waiting in a connection's send buffer. Frames of events
+// triggered through the HTTP API or by clients carry the time the event was
+// received, so the delivery latency can be observed once they are written.
+type outbound struct {
+	frame       *websocket.PreparedMessage
+	channelType string
+	ingress     time.Time // zero for messages generated by the server
+	queued      time.Time
+}
+
 type Connection struct {
 	ID              string
 	AppKey          string
+	AppID           string
+	RemoteAddr      string
 	ws              *websocket.Conn
-	send            chan []byte
+	send            chan outbound
 	manager         *Manager
 	channels        map[string]bool
 	channelsMux     sync.RWMutex
@@ -33,21 +48,31 @@ type Connection struct {
 	closing         chan struct{}
 	closeMux        sync.Mutex
 	isClosed        bool
+	closeCode       int
+	closeReason     string
 	closeOnce       sync.Once
 	rateLimiter     *rate.Limiter
+	slowConsumer    string
+	userID          string
+	userData        string
+	userMux         sync.RWMutex
 }
 
 func NewConnection(id string, ws *websocket.Conn, manager *Manager, activityTimeout time.Duration) *Connection {
 	conn := &Connection{
 		ID:              id,
 		ws:              ws,
-		send:            make(chan []byte, 512),
+		send:            make(chan outbound, 512),
 		manager:         manager,
 		channels:        make(map[string]bool),
 		activityTimeout: activityTimeout,
 		closing:         make(chan struct{}),
 		isClosed:        false,
 		rateLimiter:     rate.NewLimiter(10, 20), // default, updated per app config
+		slowConsumer:    apps.SlowConsumerDrop,
+	}
+	if ws != nil {
+		conn.RemoteAddr = ws.RemoteAddr().String()
 	}
 	conn.touchActivity()
 	return conn
@@ -57,6 +82,11 @@ func (c *Connection) SetRateLimit(eventsPerSecond int, burst int) {
 	c.rateLimiter = rate.NewLimiter(rate.Limit(eventsPerSecond), burst)
 }
 
+// SetSlowConsumerPolicy sets what happens when the send buffer is full, see apps.SlowConsumerDrop
+func (c *Connection) SetSlowConsumerPolicy(policy string) {
+	c.slowConsumer = policy
+}
+
 func (c *Connection) ReadPump() {
 	defer func() {
 		c.closeWebSocket()
@@ -117,11 +147,11 @@ func (c *Connection) WritePump() {
 
 			if !ok {
 				c.drainMessages()
-				c.ws.WriteMessage(websocket.CloseMessage, []byte{})
+				c.ws.WriteMessage(websocket.CloseMessage, c.closeFrame())
 				return
 			}
 
-			if err := c.ws.WriteMessage(websocket.TextMessage, message); err != nil {
+			if err := c.write(message); err != nil {
 				return
 			}
 
@@ -130,10 +160,10 @@ func (c *Connection) WritePump() {
 				select {
 				case message, ok := <-c.send:
 					if !ok {
-						c.ws.WriteMessage(websocket.CloseMessage, []byte{})
+						c.ws.WriteMessage(websocket.CloseMessage, c.closeFrame())
 						return
 					}
-					if err := c.ws.WriteMessage(websocket.TextMessage, message); err != nil {
+					if err := c.write(message); err != nil {
 						return
 					}
 				default:
@@ -150,7 +180,7 @@ func (c *Connection) WritePump() {
 		case <-c.closing:
 			ticker.Stop()
 			c.drainMessages()
-			c.ws.WriteMessage(websocket.CloseMessage, []byte{})
+			c.ws.WriteMessage(websocket.CloseMessage, c.closeFrame())
 			return
 		}
 	}
@@ -167,7 +197,9 @@ func (c *Connection) drainMessages() {
 				return
 			}
 
-			c.ws.WriteMessage(websocket.TextMessage, message)
+			if err := c.write(message); err != nil {
+				return
+			}
 		default:
 			return
 		}
@@ -178,18 +210,55 @@ func (c *Connection) drainMessages() {
 	}
 }
 
-func (c *Connection) SendMessage(msg *protocol.Message) error {
+// write sends a queued frame to the socket and records its delivery
+func (c *Connection) write(message outbound) error {
+	start := time.Now()
+	if err := c.ws.WritePreparedMessage(message.frame); err != nil {
+		metrics.MessageErrors.WithLabelValues(c.AppKey, "write_failed").Inc()
+		return err
+	}
+	metrics.MessagesSent.WithLabelValues(c.AppKey).Inc()
+
+	if !message.ingress.IsZero() {
+		end := time.Now()
+		metrics.MessageLatency.WithLabelValues(c.AppKey, message.channelType).Observe(end.Sub(message.ingress).Seconds())
+		metrics.MessageQueueWait.WithLabelValues(c.AppKey, message.channelType).Observe(start.Sub(message.queued).Seconds())
+		metrics.MessageWriteDuration.WithLabelValues(c.AppKey, message.channelType).Observe(end.Sub(start).Seconds())
+	}
+	return nil
+}
+
+// encodeMessage serializes a message into the payload written to the socket
+func encodeMessage(msg *protocol.Message) ([]byte, error) {
 	buf := bufferPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer bufferPool.Put(buf)
 
 	encoder := json.NewEncoder(buf)
 	if err := encoder.Encode(msg); err != nil {
-		return err
+		return nil, err
 	}
 
 	data := make([]byte, buf.Len())
 	copy(data, buf.Bytes())
+	return data, nil
+}
+
+// prepareMessage serializes a message and builds its websocket frame once,
+// the result can be written to any number of connections
+func prepareMessage(msg *protocol.Message) (*websocket.PreparedMessage, error) {
+	data, err := encodeMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	return websocket.NewPreparedMessage(websocket.TextMessage, data)
+}
+
+func (c *Connection) SendMessage(msg *protocol.Message) error {
+	prepared, err := prepareMessage(msg)
+	if err != nil {
+		return err
+	}
 
 	if log.GetLevel() == log.DebugLevel {
 		channelName := ""
@@ -199,11 +268,51 @@ func (c *Connection) SendMessage(msg *protocol.Message) error {
 		log.Debug("sending message", "connection", c.ID, "event", msg.Event, "channel", channelName)
 	}
 
+	return c.sendPrepared(outbound{frame: prepared})
+}
+
+// sendPrepared queues a frame that may be shared with other connections,
+// applying the slow consumer policy when the send buffer is full
+func (c *Connection) sendPrepared(message outbound) error {
+	message.queued = time.Now()
+
 	select {
-	case c.send <- data:
+	case c.send <- message:
 		return nil
 	default:
-		return fmt.Errorf("send buffer full")
+	}
+
+	metrics.MessagesDropped.WithLabelValues(c.AppKey, c.slowConsumer).Inc()
+
+	switch c.slowConsumer {
+	case apps.SlowConsumerDisconnect:
+		// the buffer has no room for a pusher:error, the close frame carries
+		// the code so the client reconnects after a backoff
+		log.Warn("disconnecting slow consumer", "connection", c.ID, "app", c.AppKey)
+		c.CloseWithCode(protocol.ErrorOverCapacity, "Send buffer full")
+		return ErrSendBufferFull
+
+	case apps.SlowConsumerDropOldest:
+		// other broadcasts may refill the slot, so retry a bounded number of times
+		for range 3 {
+			select {
+			case <-c.send:
+			default:
+			}
+
+			select {
+			case c.send <- message:
+				return nil
+			default:
+			}
+		}
+		return ErrSendBufferFull
+
+	default:
+		if log.GetLevel() == log.DebugLevel {
+			log.Debug("send buffer full, dropping message", "connection", c.ID, "app", c.AppKey)
+		}
+		return ErrSendBufferFull
 	}
 }
 
@@ -245,8 +354,11 @@ func (c *Connection) GetChannels() []string {
 }
 
 func (c *Connection) handleMessage(data []byte) {
+	received := time.Now()
+
 	var msg protocol.Message
 	if err := json.Unmarshal(data, &msg); err != nil {
+		metrics.MessageErrors.WithLabelValues(c.AppKey, "invalid_json").Inc()
 		if log.GetLevel() == log.DebugLevel {
 			log.Debug("failed to parse message", "connection", c.ID, "error", err)
 		}
@@ -261,8 +373,10 @@ func (c *Connection) handleMessage(data []byte) {
 		c.handleSubscribe(&msg)
 	case protocol.EventUnsubscribe:
 		c.handleUnsubscribe(&msg)
+	case protocol.EventSignin:
+		c.handleSignin(&msg)
 	default:
-		c.handleClientEvent(&msg)
+		c.handleClientEvent(&msg, received)
 	}
 }
 
@@ -298,13 +412,50 @@ func (c *Connection) handleUnsubscribe(msg *protocol.Message) {
 	c.manager.UnsubscribeConnection(c, subData.Channel)
 }
 
-func (c *Connection) handleClientEvent(msg *protocol.Message) {
+func (c *Connection) handleSignin(msg *protocol.Message) {
+	signinData, err := protocol.ParseSigninData(msg.Data)
+	if err != nil {
+		c.sendError("Invalid signin data", nil)
+		return
+	}
+
+	c.manager.SigninConnection(c, signinData)
+}
+
+// UserID returns the id of the signed in user, empty until pusher:signin succeeds
+func (c *Connection) UserID() string {
+	c.userMux.RLock()
+	defer c.userMux.RUnlock()
+	return c.userID
+}
+
+func (c *Connection) UserData() string {
+	c.userMux.RLock()
+	defer c.userMux.RUnlock()
+	return c.userData
+}
+
+// setUser attaches the authenticated user, it fails if the connection already signed in
+func (c *Connection) setUser(userID, userData string) bool {
+	c.userMux.Lock()
+	defer c.userMux.Unlock()
+
+	if c.userID != "" {
+		return false
+	}
+	c.userID = userID
+	c.userData = userData
+	return true
+}
+
+func (c *Connection) handleClientEvent(msg *protocol.Message, received time.Time) {
 	if len(msg.Event) < 7 || msg.Event[:7] != "client-" {
 		return
 	}
 
 	// rate limit client events (error 4301 per Pusher protocol)
 	if !c.rateLimiter.Allow() {
+		metrics.MessageErrors.WithLabelValues(c.AppKey, "rate_limited").Inc()
 		code := protocol.ErrorClientEventRateLimitReached
 		c.sendError("Rate limit exceeded for client events", &code)
 		return
@@ -345,7 +496,21 @@ func (c *Connection) handleClientEvent(msg *protocol.Message) {
 		return
 	}
 
-	c.manager.BroadcastToChannel(channelName, msg, c.ID)
+	c.manager.publish(context.Background(), c.AppKey, c.AppID, channelName, msg, c.ID, "client", received)
+
+	event := webhook.Event{
+		Name:     webhook.EventClientEvent,
+		Channel:  channelName,
+		Event:    msg.Event,
+		Data:     msg.Data,
+		SocketID: c.ID,
+	}
+	if protocol.IsPresenceChannel(channelName) {
+		if member, exists := c.manager.presenceStore.GetMember(c.AppID, channelName, c.ID); exists {
+			event.UserID = member.UserID
+		}
+	}
+	c.manager.fireWebhook(c.AppID, event)
 }
 
 func (c *Connection) sendError(message string, code *int) {
@@ -363,6 +528,12 @@ func (c *Connection) closeWebSocket() {
 }
 
 func (c *Connection) Close() {
+	c.CloseWithCode(0, "")
+}
+
+// CloseWithCode closes the connection sending a websocket close frame with
+// the given pusher close code, 0 sends an empty close frame
+func (c *Connection) CloseWithCode(code int, reason string) {
 	c.closeMux.Lock()
 	defer c.closeMux.Unlock()
 
@@ -370,6 +541,18 @@ func (c *Connection) Close() {
 		return
 	}
 	c.isClosed = true
+	c.closeCode = code
+	c.closeReason = reason
 
 	close(c.closing)
 }
+
+func (c *Connection) closeFrame() []byte {
+	c.closeMux.Lock()
+	defer c.closeMux.Unlock()
+
+	if c.closeCode == 0 {
+		return []byte{}
+	}
+	return websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+}
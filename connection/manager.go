@@ -3,38 +3,67 @@ package connection
 import (
 	"context"
 	"crypto/rand"
-	"encoding/hex"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/aelpxy/pulse/adapter"
 	"github.com/aelpxy/pulse/apps"
+	"github.com/aelpxy/pulse/audit"
 	"github.com/aelpxy/pulse/auth"
 	"github.com/aelpxy/pulse/channel"
+	"github.com/aelpxy/pulse/metrics"
 	"github.com/aelpxy/pulse/presence"
 	"github.com/aelpxy/pulse/protocol"
+	"github.com/aelpxy/pulse/tracing"
+	"github.com/aelpxy/pulse/webhook"
 	"github.com/charmbracelet/log"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 var (
 	ErrMaxConnectionsReached = errors.New("maximum connections reached")
 	ErrAppMaxConnections     = errors.New("app maximum connections reached")
 	ErrServerShutdown        = errors.New("server is shutting down")
+	ErrSendBufferFull        = errors.New("send buffer full")
 )
 
+type userKey struct {
+	appID  string
+	userID string
+}
+
+type channelKey struct {
+	appID       string
+	channelName string
+}
+
+// interestLock serializes the cluster subscription changes of one channel,
+// refs counts the callers holding or waiting for it
+type interestLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
 type Manager struct {
 	connections     map[string]*Connection
 	appConnCount    map[string]int
+	users           map[userKey]map[string]*Connection
 	connectionsMux  sync.RWMutex
 	channelManager  *channel.Manager
-	presenceManager *presence.Manager
+	presenceStore   presence.Store
 	appsManager     *apps.Manager
 	authService     *auth.Service
-	authServices    map[string]*auth.Service
-	authServicesMux sync.RWMutex
+	webhooks        *webhook.Dispatcher
+	audit           *audit.Logger
+	adapter         adapter.Adapter
+	interestLocks   map[channelKey]*interestLock
+	interestMux     sync.Mutex
 	activityTimeout time.Duration
 
 	maxConnections     int
@@ -54,16 +83,19 @@ func NewManager(channelManager *channel.Manager, authService *auth.Service, maxC
 	m := &Manager{
 		connections:     make(map[string]*Connection),
 		appConnCount:    make(map[string]int),
+		users:           make(map[userKey]map[string]*Connection),
+		interestLocks:   make(map[channelKey]*interestLock),
 		channelManager:  channelManager,
-		presenceManager: presence.NewManager(),
+		presenceStore:   presence.NewManager(),
 		authService:     authService,
-		authServices:    make(map[string]*auth.Service),
 		activityTimeout: 120 * time.Second,
 		maxConnections:  maxConnections,
 		connectionSem:   make(chan struct{}, maxConnections),
+		adapter:         adapter.NewMemory(),
 		ctx:             ctx,
 		cancel:          cancel,
 	}
+	m.adapter.Start(m.handleRemote, m)
 
 	// start background goroutine to close inactive connections
 	go m.cleanupInactiveConnections()
@@ -110,23 +142,55 @@ func (m *Manager) cleanupInactiveConnections() {
 	}
 }
 
-func (m *Manager) SetAuthServices(services map[string]*auth.Service) {
-	m.authServicesMux.Lock()
-	defer m.authServicesMux.Unlock()
-	m.authServices = services
-}
-
 func (m *Manager) SetAppsManager(appsManager *apps.Manager) {
 	m.appsManager = appsManager
 }
 
+func (m *Manager) SetAuditLogger(logger *audit.Logger) {
+	m.audit = logger
+}
+
+// auditConn records a security relevant event of a connection
+func (m *Manager) auditConn(conn *Connection, eventType, channelName, reason string) {
+	m.audit.Log(audit.Event{
+		Type:     eventType,
+		AppID:    conn.AppID,
+		AppKey:   conn.AppKey,
+		SocketID: conn.ID,
+		RemoteIP: audit.RemoteIP(conn.RemoteAddr),
+		Channel:  channelName,
+		Reason:   reason,
+	})
+}
+
+func (m *Manager) SetWebhookDispatcher(dispatcher *webhook.Dispatcher) {
+	m.webhooks = dispatcher
+}
+
+// SetPresenceStore replaces the in-memory presence store, stores shared between
+// nodes report the users of dead nodes so member_removed can still be sent,
+// and the users they restored after being mistaken for dead
+func (m *Manager) SetPresenceStore(store presence.Store) {
+	m.presenceStore = store
+	if reaper, ok := store.(presence.Reaper); ok {
+		reaper.SetReapHandler(m.memberRemoved)
+		reaper.SetRestoreHandler(func(appID, channelName string, member *presence.Member) {
+			m.memberAdded(appID, channelName, member, "")
+		})
+	}
+}
+
+func (m *Manager) GetPresenceStore() presence.Store {
+	return m.presenceStore
+}
+
+// getAuthService builds the auth service from the app's current keys and
+// secrets, so changes made in the app store apply without a restart. Read
+// only keys can't sign channel or user auth.
 func (m *Manager) getAuthService(appKey string) *auth.Service {
-	if appKey != "" {
-		m.authServicesMux.RLock()
-		svc, exists := m.authServices[appKey]
-		m.authServicesMux.RUnlock()
-		if exists {
-			return svc
+	if appKey != "" && m.appsManager != nil {
+		if app, exists := m.appsManager.GetApp(appKey); exists {
+			return app.AuthService(false)
 		}
 	}
 
@@ -135,12 +199,14 @@ func (m *Manager) getAuthService(appKey string) *auth.Service {
 
 func (m *Manager) RegisterWithApp(ws *websocket.Conn, appKey string) (*Connection, error) {
 	if atomic.LoadInt32(&m.shutdown) == 1 {
+		metrics.ConnectionsRejected.WithLabelValues(appKey, "shutdown").Inc()
 		return nil, ErrServerShutdown
 	}
 
 	select {
 	case m.connectionSem <- struct{}{}:
 	default:
+		metrics.ConnectionsRejected.WithLabelValues(appKey, "max_connections").Inc()
 		return nil, ErrMaxConnectionsReached
 	}
 
@@ -153,16 +219,13 @@ func (m *Manager) RegisterWithApp(ws *websocket.Conn, appKey string) (*Connectio
 	conn := NewConnection(socketID, ws, m, m.activityTimeout)
 	conn.AppKey = appKey
 
-	// set rate limits from app config
-	if m.appsManager != nil {
-		if app, exists := m.appsManager.GetApp(appKey); exists {
-			conn.SetRateLimit(app.GetMaxEventRate(), app.GetMaxEventBurst())
-		}
-	}
-
+	// set app id and rate limits from app config
 	appMaxConnections := 0
 	if appKey != "" && m.appsManager != nil {
 		if app, exists := m.appsManager.GetApp(appKey); exists {
+			conn.AppID = app.ID
+			conn.SetRateLimit(app.GetMaxEventRate(), app.GetMaxEventBurst())
+			conn.SetSlowConsumerPolicy(app.GetSlowConsumerPolicy())
 			appMaxConnections = app.MaxConnections
 		}
 	}
@@ -171,6 +234,7 @@ func (m *Manager) RegisterWithApp(ws *websocket.Conn, appKey string) (*Connectio
 	if appMaxConnections > 0 && m.appConnCount[appKey] >= appMaxConnections {
 		m.connectionsMux.Unlock()
 		<-m.connectionSem
+		metrics.ConnectionsRejected.WithLabelValues(appKey, "app_max_connections").Inc()
 		return nil, ErrAppMaxConnections
 	}
 	m.connections[socketID] = conn
@@ -181,6 +245,9 @@ func (m *Manager) RegisterWithApp(ws *websocket.Conn, appKey string) (*Connectio
 	currentConns := atomic.LoadInt64(&m.currentConnections)
 	m.connectionsMux.Unlock()
 
+	metrics.ConnectionsTotal.WithLabelValues(appKey).Inc()
+	metrics.ConnectionsActive.WithLabelValues(appKey).Inc()
+
 	log.Debug("connection registered", "id", socketID, "app", appKey, "active_connections", currentConns)
 
 	m.wg.Add(1)
@@ -215,7 +282,15 @@ func (m *Manager) Unregister(conn *Connection) {
 				m.appConnCount[conn.AppKey] = count - 1
 			}
 		}
+		if userID := conn.UserID(); userID != "" {
+			key := userKey{appID: conn.AppID, userID: userID}
+			delete(m.users[key], conn.ID)
+			if len(m.users[key]) == 0 {
+				delete(m.users, key)
+			}
+		}
 		atomic.AddInt64(&m.currentConnections, -1)
+		metrics.ConnectionsActive.WithLabelValues(conn.AppKey).Dec()
 		log.Debug("connection unregistered", "id", conn.ID, "active_connections", atomic.LoadInt64(&m.currentConnections))
 	}
 	m.connectionsMux.Unlock()
@@ -225,18 +300,7 @@ func (m *Manager) Unregister(conn *Connection) {
 	}
 
 	for _, channelName := range conn.GetChannels() {
-		if protocol.IsPresenceChannel(channelName) {
-			member := m.presenceManager.RemoveMember(channelName, conn.ID)
-			if member != nil {
-				memberRemovedMsg, err := protocol.NewMemberRemoved(channelName, map[string]any{
-					"user_id": member.UserID,
-				})
-				if err == nil {
-					m.BroadcastToChannel(channelName, memberRemovedMsg, "")
-				}
-			}
-		}
-		m.channelManager.Unsubscribe(channelName, conn.ID)
+		m.leaveChannel(conn, channelName)
 	}
 
 	conn.Close()
@@ -258,6 +322,27 @@ func (m *Manager) GetConnection(id string) (*Connection, bool) {
 
 func (m *Manager) SubscribeConnection(conn *Connection, subData *protocol.SubscribeData) {
 	channelName := subData.Channel
+
+	// user events are delivered through the user index, so subscribing to the
+	// user's own channel only confirms it
+	if protocol.IsServerToUserChannel(channelName) {
+		if conn.UserID() == "" || channelName != protocol.ServerToUserChannel(conn.UserID()) {
+			m.auditConn(conn, audit.TypeChannelAuthFailed, channelName, "not the signed in user's channel")
+			code := protocol.ErrorConnectionIsUnauthorized
+			conn.sendError("Only the signed in user's own channel may be subscribed to", &code)
+			return
+		}
+		if successMsg, err := protocol.NewSubscriptionSucceeded(channelName); err == nil {
+			conn.SendMessage(successMsg)
+		}
+		return
+	}
+
+	if err := protocol.ValidateChannelName(channelName); err != nil {
+		conn.sendError(err.Error(), nil)
+		return
+	}
+
 	isPresence := protocol.IsPresenceChannel(channelName)
 	var presenceMember *presence.Member
 
@@ -265,6 +350,7 @@ func (m *Manager) SubscribeConnection(conn *Connection, subData *protocol.Subscr
 		if subData.ChannelData != nil && *subData.ChannelData != "" {
 			member, err := presence.ParseChannelData(*subData.ChannelData)
 			if err != nil {
+				m.auditConn(conn, audit.TypeChannelAuthFailed, channelName, "invalid channel_data")
 				code := protocol.ErrorConnectionIsUnauthorized
 				conn.sendError("Invalid channel_data for presence channel", &code)
 				return
@@ -280,6 +366,7 @@ func (m *Manager) SubscribeConnection(conn *Connection, subData *protocol.Subscr
 
 	if protocol.IsPrivateChannel(channelName) || isPresence || protocol.IsEncryptedChannel(channelName) {
 		if subData.Auth == nil {
+			m.auditConn(conn, audit.TypeChannelAuthFailed, channelName, "missing auth")
 			code := protocol.ErrorConnectionIsUnauthorized
 			conn.sendError("Authentication required for private/presence channels", &code)
 			return
@@ -287,11 +374,14 @@ func (m *Manager) SubscribeConnection(conn *Connection, subData *protocol.Subscr
 
 		authSvc := m.getAuthService(conn.AppKey)
 		if authSvc == nil {
+			m.auditConn(conn, audit.TypeChannelAuthFailed, channelName, "no auth service configured")
 			code := protocol.ErrorConnectionIsUnauthorized
 			conn.sendError("No auth service configured", &code)
 			return
 		}
-		if !authSvc.ValidateAuth(*subData.Auth, conn.ID, channelName, subData.ChannelData) {
+		if err := authSvc.CheckAuth(*subData.Auth, conn.ID, channelName, subData.ChannelData); err != nil {
+			metrics.MessageErrors.WithLabelValues(conn.AppKey, "auth_failed").Inc()
+			m.auditConn(conn, audit.TypeChannelAuthFailed, channelName, err.Error())
 			code := protocol.CloseInvalidSignature
 			conn.sendError("Invalid authentication signature", &code)
 			return
@@ -308,22 +398,33 @@ func (m *Manager) SubscribeConnection(conn *Connection, subData *protocol.Subscr
 		}
 	}
 
-	if err := m.channelManager.Subscribe(channelName, conn.ID); err != nil {
+	occupied, err := m.channelManager.Subscribe(conn.AppID, channelName, conn.ID)
+	if err != nil {
 		conn.sendError(fmt.Sprintf("Failed to subscribe: %v", err), nil)
 		return
 	}
 
 	conn.Subscribe(channelName)
+	metrics.ChannelSubscriptions.WithLabelValues(conn.AppKey, metrics.GetChannelType(channelName)).Inc()
 
-	if isPresence {
-		m.presenceManager.AddMember(channelName, conn.ID, presenceMember)
+	if occupied {
+		m.syncInterest(conn.AppID, channelName)
+	}
 
-		memberAddedMsg, err := protocol.NewMemberAdded(channelName, presenceMember)
-		if err == nil {
-			m.BroadcastToChannel(channelName, memberAddedMsg, conn.ID)
+	if isPresence {
+		joined, err := m.presenceStore.AddMember(conn.AppID, channelName, conn.ID, presenceMember)
+		if err != nil {
+			log.Error("failed to join presence channel", "app", conn.AppID, "channel", channelName, "error", err)
+			m.UnsubscribeConnection(conn, channelName)
+			conn.sendError("Failed to subscribe: presence unavailable", nil)
+			return
+		}
+		// member_added is only sent when the user's first connection joins
+		if joined {
+			m.memberAdded(conn.AppID, channelName, presenceMember, conn.ID)
 		}
 
-		presenceData := m.presenceManager.GetPresenceData(channelName)
+		presenceData := m.presenceStore.GetPresenceData(conn.AppID, channelName)
 		successMsg, err := protocol.NewSubscriptionSucceededWithPresence(channelName, presenceData)
 		if err != nil {
 			return
@@ -338,48 +439,337 @@ func (m *Manager) SubscribeConnection(conn *Connection, subData *protocol.Subscr
 	}
 }
 
+// SigninConnection authenticates the user of a connection from a pusher:signin message
+func (m *Manager) SigninConnection(conn *Connection, signinData *protocol.SigninData) {
+	code := protocol.ErrorConnectionIsUnauthorized
+
+	if conn.UserID() != "" {
+		conn.sendError("Connection is already signed in", &code)
+		return
+	}
+
+	authSvc := m.getAuthService(conn.AppKey)
+	if authSvc == nil {
+		m.auditConn(conn, audit.TypeUserAuthFailed, "", "no auth service configured")
+		conn.sendError("No auth service configured", &code)
+		return
+	}
+
+	if err := authSvc.CheckUserAuth(signinData.Auth, conn.ID, signinData.UserData); err != nil {
+		metrics.MessageErrors.WithLabelValues(conn.AppKey, "auth_failed").Inc()
+		m.auditConn(conn, audit.TypeUserAuthFailed, "", err.Error())
+		conn.sendError("Invalid signin signature", &code)
+		conn.CloseWithCode(code, "Invalid signin signature")
+		return
+	}
+
+	userData, err := protocol.ParseUserData(signinData.UserData)
+	if err != nil || userData.ID == "" {
+		conn.sendError("user_data must be a JSON object with a non-empty id", &code)
+		conn.CloseWithCode(code, "Invalid user_data")
+		return
+	}
+
+	m.connectionsMux.Lock()
+	if _, registered := m.connections[conn.ID]; !registered {
+		m.connectionsMux.Unlock()
+		return
+	}
+	if !conn.setUser(userData.ID, signinData.UserData) {
+		m.connectionsMux.Unlock()
+		conn.sendError("Connection is already signed in", &code)
+		return
+	}
+	key := userKey{appID: conn.AppID, userID: userData.ID}
+	if m.users[key] == nil {
+		m.users[key] = make(map[string]*Connection)
+	}
+	m.users[key][conn.ID] = conn
+	m.connectionsMux.Unlock()
+
+	log.Debug("connection signed in", "id", conn.ID, "app", conn.AppKey, "user", userData.ID)
+
+	successMsg, err := protocol.NewSigninSuccess(signinData.UserData)
+	if err != nil {
+		return
+	}
+	conn.SendMessage(successMsg)
+}
+
 func (m *Manager) UnsubscribeConnection(conn *Connection, channelName string) {
+	m.leaveChannel(conn, channelName)
+	conn.Unsubscribe(channelName)
+}
+
+// leaveChannel removes the connection from the channel and its presence members,
+// notifying members and webhooks about the resulting transitions
+func (m *Manager) leaveChannel(conn *Connection, channelName string) {
 	if protocol.IsPresenceChannel(channelName) {
-		member := m.presenceManager.RemoveMember(channelName, conn.ID)
-		if member != nil {
-			memberRemovedMsg, err := protocol.NewMemberRemoved(channelName, map[string]interface{}{
-				"user_id": member.UserID,
-			})
-			if err == nil {
-				m.BroadcastToChannel(channelName, memberRemovedMsg, "")
-			}
+		member, userLeft := m.presenceStore.RemoveMember(conn.AppID, channelName, conn.ID)
+		if member != nil && userLeft {
+			m.memberRemoved(conn.AppID, channelName, member)
 		}
 	}
 
-	m.channelManager.Unsubscribe(channelName, conn.ID)
-	conn.Unsubscribe(channelName)
+	if m.channelManager.Unsubscribe(conn.AppID, channelName, conn.ID) {
+		m.syncInterest(conn.AppID, channelName)
+	}
 }
 
-func (m *Manager) BroadcastToChannel(channelName string, msg *protocol.Message, excludeConnID string) {
-	connIDs := m.channelManager.GetSubscribers(channelName)
+// memberRemoved notifies the channel and webhooks that a user left
+// memberAdded tells the channel and webhooks that a user joined, excluding the
+// connection it joined with
+func (m *Manager) memberAdded(appID, channelName string, member *presence.Member, excludeConnID string) {
+	memberAddedMsg, err := protocol.NewMemberAdded(channelName, member)
+	if err == nil {
+		m.BroadcastToChannel(appID, channelName, memberAddedMsg, excludeConnID)
+	}
+	m.fireWebhook(appID, webhook.Event{Name: webhook.EventMemberAdded, Channel: channelName, UserID: member.UserID})
+}
+
+func (m *Manager) memberRemoved(appID, channelName string, member *presence.Member) {
+	memberRemovedMsg, err := protocol.NewMemberRemoved(channelName, map[string]any{
+		"user_id": member.UserID,
+	})
+	if err == nil {
+		m.BroadcastToChannel(appID, channelName, memberRemovedMsg, "")
+	}
+	m.fireWebhook(appID, webhook.Event{Name: webhook.EventMemberRemoved, Channel: channelName, UserID: member.UserID})
+}
+
+func (m *Manager) fireWebhook(appID string, event webhook.Event) {
+	if m.webhooks == nil || m.appsManager == nil {
+		return
+	}
+
+	if app, exists := m.appsManager.GetAppByID(appID); exists {
+		m.webhooks.Dispatch(app, event)
+	}
+}
+
+// BroadcastToChannel sends msg to every connection of the given app subscribed
+// to channelName on any node, skipping excludeConnID
+func (m *Manager) BroadcastToChannel(appID, channelName string, msg *protocol.Message, excludeConnID string) {
+	m.broadcast(context.Background(), appID, channelName, msg, excludeConnID, time.Time{})
+}
+
+// broadcast is BroadcastToChannel for events received at ingress, which is
+// carried along to observe their delivery latency. The fan-out is traced
+// when ctx belongs to a trace.
+func (m *Manager) broadcast(ctx context.Context, appID, channelName string, msg *protocol.Message, excludeConnID string, ingress time.Time) {
+	ctx, span := tracing.StartChild(ctx, "pulse.broadcast",
+		attribute.String("pulse.app_id", appID),
+		attribute.String("pulse.channel", channelName),
+		attribute.String("pulse.event", msg.Event),
+	)
+	defer span.End()
+
+	data, err := encodeMessage(msg)
+	if err != nil {
+		metrics.MessageErrors.WithLabelValues(m.appKey(appID), "encode_failed").Inc()
+		span.SetStatus(codes.Error, err.Error())
+		log.Error("failed to encode broadcast", "app", appID, "channel", channelName, "event", msg.Event, "error", err)
+		return
+	}
+
+	delivered := m.broadcastLocal(appID, channelName, data, excludeConnID, ingress)
+	span.SetAttributes(attribute.Int("pulse.subscribers", delivered))
+
+	m.publishRemote(ctx, &adapter.Message{
+		Type:            adapter.TypeChannel,
+		AppID:           appID,
+		Channel:         channelName,
+		ExcludeSocketID: excludeConnID,
+		Payload:         data,
+		Ingress:         unixNano(ingress),
+	})
+}
+
+// broadcastLocal writes an encoded message to the subscribers connected to
+// this node and returns how many it was queued for
+func (m *Manager) broadcastLocal(appID, channelName string, data []byte, excludeConnID string, ingress time.Time) int {
+	connIDs := m.channelManager.GetSubscribers(appID, channelName)
+	if len(connIDs) == 0 {
+		return 0
+	}
+
+	// frame once, then share the prepared frame between all subscribers
+	prepared, err := websocket.NewPreparedMessage(websocket.TextMessage, data)
+	if err != nil {
+		log.Error("failed to prepare broadcast", "app", appID, "channel", channelName, "error", err)
+		return 0
+	}
+
+	message := outbound{frame: prepared, channelType: metrics.GetChannelType(channelName), ingress: ingress}
 
 	m.connectionsMux.RLock()
 	defer m.connectionsMux.RUnlock()
 
+	delivered := 0
 	for _, connID := range connIDs {
 		if connID == excludeConnID {
 			continue
 		}
 
 		if conn, exists := m.connections[connID]; exists {
-			conn.SendMessage(msg)
+			if conn.sendPrepared(message) == nil {
+				delivered++
+			}
 		}
 	}
+	return delivered
+}
+
+// PublishToChannel sends a server event to the channel, data is delivered
+// verbatim and excludeSocketID lets publishers skip the originating client.
+// ingress is when the event was received, for latency metrics.
+func (m *Manager) PublishToChannel(ctx context.Context, appID, channelName string, event string, data string, excludeSocketID string, ingress time.Time) {
+	msg := &protocol.Message{
+		Event:   event,
+		Channel: &channelName,
+		Data:    data,
+	}
+
+	m.publish(ctx, m.appKey(appID), appID, channelName, msg, excludeSocketID, "server", ingress)
+}
+
+// publish broadcasts an event triggered through the HTTP API or by a client
+// and records it, eventType tells the two apart
+func (m *Manager) publish(ctx context.Context, appKey, appID, channelName string, msg *protocol.Message, excludeConnID, eventType string, ingress time.Time) {
+	m.broadcast(ctx, appID, channelName, msg, excludeConnID, ingress)
+	metrics.MessagesPublished.WithLabelValues(appKey, eventType).Inc()
+}
+
+// appKey returns the key of an app for metric labels, empty when it is unknown
+func (m *Manager) appKey(appID string) string {
+	if m.appsManager == nil {
+		return ""
+	}
+	if app, exists := m.appsManager.GetAppByID(appID); exists {
+		return app.Key
+	}
+	return ""
 }
 
-func (m *Manager) PublishToChannel(channelName string, event string, data any) error {
-	msg, err := protocol.NewMessage(event, &channelName, data)
+// GetUserConnections returns the signed in connections of a user on this node
+func (m *Manager) GetUserConnections(appID, userID string) []*Connection {
+	m.connectionsMux.RLock()
+	defer m.connectionsMux.RUnlock()
+
+	userConns := m.users[userKey{appID: appID, userID: userID}]
+	conns := make([]*Connection, 0, len(userConns))
+	for _, conn := range userConns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// SendToUser delivers an event to every connection the user signed in with,
+// on the reserved #server-to-user-{id} channel
+func (m *Manager) SendToUser(ctx context.Context, appID, userID string, event string, data string, ingress time.Time) {
+	ctx, span := tracing.StartChild(ctx, "pulse.send_to_user",
+		attribute.String("pulse.app_id", appID),
+		attribute.String("pulse.user_id", userID),
+		attribute.String("pulse.event", event),
+	)
+	defer span.End()
+
+	channelName := protocol.ServerToUserChannel(userID)
+	encoded, err := encodeMessage(&protocol.Message{
+		Event:   event,
+		Channel: &channelName,
+		Data:    data,
+	})
 	if err != nil {
-		return err
+		metrics.MessageErrors.WithLabelValues(m.appKey(appID), "encode_failed").Inc()
+		log.Error("failed to encode user event", "app", appID, "user", userID, "event", event, "error", err)
+		return
 	}
 
-	m.BroadcastToChannel(channelName, msg, "")
-	return nil
+	metrics.MessagesPublished.WithLabelValues(m.appKey(appID), "user").Inc()
+
+	delivered := m.sendToUserLocal(appID, userID, encoded, ingress)
+	span.SetAttributes(attribute.Int("pulse.connections", delivered))
+
+	m.publishRemote(ctx, &adapter.Message{
+		Type:    adapter.TypeUser,
+		AppID:   appID,
+		UserID:  userID,
+		Payload: encoded,
+		Ingress: unixNano(ingress),
+	})
+}
+
+// sendToUserLocal writes an encoded message to the connections of a user on
+// this node and returns how many it was queued for
+func (m *Manager) sendToUserLocal(appID, userID string, data []byte, ingress time.Time) int {
+	conns := m.GetUserConnections(appID, userID)
+	if len(conns) == 0 {
+		return 0
+	}
+
+	prepared, err := websocket.NewPreparedMessage(websocket.TextMessage, data)
+	if err != nil {
+		log.Error("failed to prepare user event", "app", appID, "user", userID, "error", err)
+		return 0
+	}
+
+	message := outbound{frame: prepared, channelType: "user", ingress: ingress}
+	delivered := 0
+	for _, conn := range conns {
+		if conn.sendPrepared(message) == nil {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+// TerminateUserConnections closes every connection of a user with a
+// 4009 close code, which tells clients not to reconnect. It returns the
+// number of connections closed on this node.
+func (m *Manager) TerminateUserConnections(appID, userID string) int {
+	count := m.terminateUserLocal(appID, userID)
+	m.publishRemote(context.Background(), &adapter.Message{
+		Type:   adapter.TypeTerminateUser,
+		AppID:  appID,
+		UserID: userID,
+	})
+	return count
+}
+
+func (m *Manager) terminateUserLocal(appID, userID string) int {
+	conns := m.GetUserConnections(appID, userID)
+
+	code := protocol.ErrorConnectionIsUnauthorized
+	for _, conn := range conns {
+		conn.sendError("Connection terminated by the server", &code)
+		conn.CloseWithCode(code, "Connection terminated")
+	}
+
+	if len(conns) > 0 {
+		log.Debug("terminated user connections", "app", appID, "user", userID, "count", len(conns))
+	}
+	return len(conns)
+}
+
+// DisconnectApp closes every connection of an app that was removed, disabled
+// or rekeyed with a 4003 error. It returns the number of connections closed.
+func (m *Manager) DisconnectApp(appID string) int {
+	m.connectionsMux.RLock()
+	var conns []*Connection
+	for _, conn := range m.connections {
+		if conn.AppID == appID {
+			conns = append(conns, conn)
+		}
+	}
+	m.connectionsMux.RUnlock()
+
+	code := protocol.ErrorApplicationDisabled
+	for _, conn := range conns {
+		conn.sendError("Application disabled", &code)
+		conn.CloseWithCode(protocol.CloseApplicationDisabled, "Application disabled")
+	}
+	return len(conns)
 }
 
 func (m *Manager) Shutdown(timeout time.Duration) error {
@@ -428,12 +818,14 @@ func (m *Manager) IsShuttingDown() bool {
 	return atomic.LoadInt32(&m.shutdown) == 1
 }
 
+// generateSocketID returns an id in the "digits.digits" format the Pusher
+// SDKs validate before signing channel auth or excluding a socket
 func generateSocketID() (string, error) {
 	b := make([]byte, 8)
 	if _, err := rand.Read(b); err != nil {
 		return "", err
 	}
 
-	socketID := hex.EncodeToString(b[:4]) + "." + hex.EncodeToString(b[4:])
+	socketID := fmt.Sprintf("%d.%d", binary.BigEndian.Uint32(b[:4]), binary.BigEndian.Uint32(b[4:]))
 	return socketID, nil
 }
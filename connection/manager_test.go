@@ -0,0 +1,529 @@
+package connection
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aelpxy/pulse/apps"
+	"github.com/aelpxy/pulse/auth"
+	"github.com/aelpxy/pulse/channel"
+	"github.com/aelpxy/pulse/metrics"
+	"github.com/aelpxy/pulse/protocol"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func testApp(id string) *apps.App {
+	return &apps.App{ID: id, Key: id + "-key", Secret: id + "-secret", Enabled: true}
+}
+
+// newTestManager returns a manager serving the given apps and the URL its
+// websocket endpoint listens on, clients connect to url + "/app/{key}"
+func newTestManager(t testing.TB, appList ...*apps.App) (*Manager, string) {
+	t.Helper()
+
+	appsMgr := apps.NewManager()
+	for _, app := range appList {
+		appsMgr.AddApp(app)
+	}
+
+	m := NewManager(channel.NewManager(), nil, 1000)
+	m.SetAppsManager(appsMgr)
+	t.Cleanup(func() { m.Shutdown(5 * time.Second) })
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn, err := m.RegisterWithApp(ws, strings.TrimPrefix(r.URL.Path, "/app/"))
+		if err != nil {
+			ws.Close()
+			return
+		}
+		go conn.WritePump()
+		go conn.ReadPump()
+	}))
+	t.Cleanup(server.Close)
+
+	return m, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// testClient is a pusher client connected to a test manager
+type testClient struct {
+	t        testing.TB
+	ws       *websocket.Conn
+	app      *apps.App
+	socketID string
+	messages chan *protocol.Message
+	closeErr error // read error that ended the connection, set before messages is closed
+}
+
+func dial(t testing.TB, url string, app *apps.App) *testClient {
+	t.Helper()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url+"/app/"+app.Key, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	c := &testClient{t: t, ws: ws, app: app, messages: make(chan *protocol.Message, 64)}
+	// a read deadline breaks the connection, so reads are never interrupted
+	go func() {
+		defer close(c.messages)
+		for {
+			var msg protocol.Message
+			if err := ws.ReadJSON(&msg); err != nil {
+				c.closeErr = err
+				return
+			}
+			c.messages <- &msg
+		}
+	}()
+
+	msg := c.expect(protocol.EventConnectionEstablished, "")
+
+	var established protocol.ConnectionEstablishedData
+	if err := json.Unmarshal([]byte(msg.Data), &established); err != nil {
+		t.Fatalf("connection_established data %q: %v", msg.Data, err)
+	}
+	c.socketID = established.SocketID
+	return c
+}
+
+func (c *testClient) send(event string, data any) {
+	c.t.Helper()
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.ws.WriteJSON(map[string]any{"event": event, "data": json.RawMessage(raw)}); err != nil {
+		c.t.Fatalf("write %s: %v", event, err)
+	}
+}
+
+// subscribe joins a channel, signing the subscription for private and
+// presence channels, and waits until it succeeded
+func (c *testClient) subscribe(channelName string, member map[string]any) {
+	c.t.Helper()
+
+	data := map[string]any{"channel": channelName}
+	if strings.HasPrefix(channelName, "private-") || strings.HasPrefix(channelName, "presence-") {
+		var channelData *string
+		if member != nil {
+			encoded, _ := json.Marshal(member)
+			s := string(encoded)
+			channelData = &s
+			data["channel_data"] = s
+		}
+		data["auth"] = auth.NewService(c.app.Key, c.app.Secret).GenerateAuthString(c.socketID, channelName, channelData)
+	}
+
+	c.send(protocol.EventSubscribe, data)
+	c.expect(protocol.EventSubscriptionSucceeded, channelName)
+}
+
+// signin authenticates the connection as the user of userData and waits
+// until it succeeded
+func (c *testClient) signin(userData string) {
+	c.t.Helper()
+
+	signature := auth.NewService(c.app.Key, c.app.Secret).GenerateUserSignature(c.socketID, userData)
+	c.send(protocol.EventSignin, protocol.SigninData{Auth: c.app.Key + ":" + signature, UserData: userData})
+	c.expect(protocol.EventSigninSuccess, "")
+}
+
+// expectError waits for a pusher:error and returns its code
+func (c *testClient) expectError() int {
+	c.t.Helper()
+
+	msg := c.expect(protocol.EventError, "")
+	var data protocol.ErrorData
+	if err := json.Unmarshal([]byte(msg.Data), &data); err != nil {
+		c.t.Fatalf("pusher:error data %q: %v", msg.Data, err)
+	}
+	if data.Code == nil {
+		return 0
+	}
+	return *data.Code
+}
+
+// expectClose waits until the server closes the connection and returns the
+// close frame it sent
+func (c *testClient) expectClose() *websocket.CloseError {
+	c.t.Helper()
+
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case _, ok := <-c.messages:
+			if ok {
+				continue
+			}
+			var closeErr *websocket.CloseError
+			if !errors.As(c.closeErr, &closeErr) {
+				c.t.Fatalf("%s closed without a close frame: %v", c.socketID, c.closeErr)
+			}
+			return closeErr
+		case <-deadline:
+			c.t.Fatalf("%s was not closed", c.socketID)
+			return nil
+		}
+	}
+}
+
+// next returns the next message, or false when none arrives within wait
+func (c *testClient) next(wait time.Duration) (*protocol.Message, bool) {
+	select {
+	case msg, ok := <-c.messages:
+		return msg, ok
+	case <-time.After(wait):
+		return nil, false
+	}
+}
+
+// expect skips messages until event arrives on channelName
+func (c *testClient) expect(event, channelName string) *protocol.Message {
+	c.t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		msg, ok := c.next(time.Until(deadline))
+		if !ok {
+			break
+		}
+		if msg.Event == event && (channelName == "" || msg.Channel != nil && *msg.Channel == channelName) {
+			return msg
+		}
+	}
+	c.t.Fatalf("%s did not receive %s on %q", c.socketID, event, channelName)
+	return nil
+}
+
+// expectNone fails if event arrives within wait
+func (c *testClient) expectNone(event string, wait time.Duration) {
+	c.t.Helper()
+
+	deadline := time.Now().Add(wait)
+	for {
+		msg, ok := c.next(time.Until(deadline))
+		if !ok {
+			return
+		}
+		if msg.Event == event {
+			c.t.Fatalf("%s received %s on %v: %s", c.socketID, event, *msg.Channel, msg.Data)
+		}
+	}
+}
+
+func TestPublishIsolatesApps(t *testing.T) {
+	appA, appB := testApp("app-a"), testApp("app-b")
+	m, url := newTestManager(t, appA, appB)
+
+	alice := dial(t, url, appA)
+	alice.subscribe("presence-lobby", map[string]any{"user_id": "alice"})
+
+	bob := dial(t, url, appB)
+	bob.subscribe("presence-lobby", map[string]any{"user_id": "bob"})
+
+	// alice joined first, so a member_added of app-b reaching her would leak too
+	alice.expectNone(protocol.EventMemberAdded, 100*time.Millisecond)
+
+	m.PublishToChannel(t.Context(), appA.ID, "presence-lobby", "order-placed", `{"id":1}`, "", time.Now())
+
+	if msg := alice.expect("order-placed", "presence-lobby"); msg.Data != `{"id":1}` {
+		t.Errorf("app-a received data %q", msg.Data)
+	}
+	bob.expectNone("order-placed", 200*time.Millisecond)
+
+	if members := m.GetPresenceStore().GetUserIDs(appB.ID, "presence-lobby"); len(members) != 1 || members[0] != "bob" {
+		t.Errorf("app-b members = %v, want [bob]", members)
+	}
+	if count, _ := m.GetSubscriptionCount(t.Context(), appA.ID, "presence-lobby"); count != 1 {
+		t.Errorf("app-a subscription count = %d, want 1", count)
+	}
+}
+
+func TestClientEventsIsolateApps(t *testing.T) {
+	appA, appB := testApp("app-a"), testApp("app-b")
+	enabled := true
+	appA.EnableClientEvents = &enabled
+	appB.EnableClientEvents = &enabled
+	_, url := newTestManager(t, appA, appB)
+
+	sender := dial(t, url, appA)
+	sender.subscribe("private-chat", nil)
+	peer := dial(t, url, appA)
+	peer.subscribe("private-chat", nil)
+	other := dial(t, url, appB)
+	other.subscribe("private-chat", nil)
+
+	sender.ws.WriteJSON(map[string]any{"event": "client-typing", "channel": "private-chat", "data": "{}"})
+
+	peer.expect("client-typing", "private-chat")
+	other.expectNone("client-typing", 200*time.Millisecond)
+}
+
+func TestSubscribeOwnUserChannel(t *testing.T) {
+	app := testApp("app")
+	_, url := newTestManager(t, app)
+
+	alice := dial(t, url, app)
+	alice.send(protocol.EventSubscribe, map[string]any{"channel": "#server-to-user-alice"})
+	if code := alice.expectError(); code != protocol.ErrorConnectionIsUnauthorized {
+		t.Errorf("subscribing before signin failed with code %d, want %d", code, protocol.ErrorConnectionIsUnauthorized)
+	}
+
+	alice.signin(`{"id":"alice"}`)
+	alice.subscribe("#server-to-user-alice", nil)
+
+	alice.send(protocol.EventSubscribe, map[string]any{"channel": "#server-to-user-bob"})
+	if code := alice.expectError(); code != protocol.ErrorConnectionIsUnauthorized {
+		t.Errorf("subscribing to another user's channel failed with code %d, want %d", code, protocol.ErrorConnectionIsUnauthorized)
+	}
+}
+
+func TestSignin(t *testing.T) {
+	app := testApp("app")
+	m, url := newTestManager(t, app)
+
+	alice := dial(t, url, app)
+	alice.signin(`{"id":"alice","user_info":{"name":"Alice"}}`)
+	if conns := m.GetUserConnections(app.ID, "alice"); len(conns) != 1 || conns[0].ID != alice.socketID {
+		t.Errorf("connections of alice = %v, want %s", conns, alice.socketID)
+	}
+
+	tests := []struct {
+		name     string
+		userData string
+		auth     func(c *testClient, userData string) string
+		reason   string
+	}{
+		{
+			name:     "bad signature",
+			userData: `{"id":"mallory"}`,
+			auth: func(c *testClient, userData string) string {
+				return c.app.Key + ":" + auth.NewService(c.app.Key, "wrong-secret").GenerateUserSignature(c.socketID, userData)
+			},
+			reason: "Invalid signin signature",
+		},
+		{
+			name:     "user_data without id",
+			userData: `{"user_info":{"name":"Nobody"}}`,
+			auth: func(c *testClient, userData string) string {
+				return c.app.Key + ":" + auth.NewService(c.app.Key, c.app.Secret).GenerateUserSignature(c.socketID, userData)
+			},
+			reason: "Invalid user_data",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dial(t, url, app)
+			c.send(protocol.EventSignin, protocol.SigninData{Auth: tt.auth(c, tt.userData), UserData: tt.userData})
+
+			if code := c.expectError(); code != protocol.ErrorConnectionIsUnauthorized {
+				t.Errorf("signin failed with code %d, want %d", code, protocol.ErrorConnectionIsUnauthorized)
+			}
+			closeErr := c.expectClose()
+			if closeErr.Code != protocol.ErrorConnectionIsUnauthorized || closeErr.Text != tt.reason {
+				t.Errorf("closed with %d %q, want %d %q", closeErr.Code, closeErr.Text, protocol.ErrorConnectionIsUnauthorized, tt.reason)
+			}
+		})
+	}
+}
+
+func TestConnectionsActive(t *testing.T) {
+	app := testApp("metrics")
+	m, url := newTestManager(t, app)
+	active := metrics.ConnectionsActive.WithLabelValues(app.Key)
+
+	alice := dial(t, url, app)
+	bob := dial(t, url, app)
+	if got := testutil.ToFloat64(active); got != 2 {
+		t.Fatalf("active connections = %v, want 2", got)
+	}
+
+	alice.ws.Close()
+	waitFor(t, func() bool { return testutil.ToFloat64(active) == 1 })
+
+	// unregistering twice must not count the connection twice
+	m.connectionsMux.RLock()
+	var conn *Connection
+	for _, c := range m.connections {
+		conn = c
+	}
+	m.connectionsMux.RUnlock()
+	m.Unregister(conn)
+	m.Unregister(conn)
+	if got := testutil.ToFloat64(active); got != 0 {
+		t.Errorf("active connections = %v after bob left, want 0", got)
+	}
+	bob.ws.Close()
+}
+
+// waitFor polls cond until it holds or two seconds passed
+func waitFor(t testing.TB, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPublishObservesLatency(t *testing.T) {
+	app := testApp("latency")
+	m, url := newTestManager(t, app)
+
+	alice := dial(t, url, app)
+	alice.subscribe("private-orders", nil)
+
+	before := sampleCount(t, app.Key, "private")
+	m.PublishToChannel(t.Context(), app.ID, "private-orders", "order-placed", `{}`, "", time.Now())
+	alice.expect("order-placed", "private-orders")
+
+	waitFor(t, func() bool { return sampleCount(t, app.Key, "private") == before+1 })
+}
+
+// sampleCount returns how many events the latency histogram recorded for an app and channel type
+func sampleCount(t testing.TB, appKey, channelType string) uint64 {
+	t.Helper()
+
+	var m dto.Metric
+	if err := metrics.MessageLatency.WithLabelValues(appKey, channelType).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestSlowConsumerIsDisconnected(t *testing.T) {
+	app := testApp("app")
+	app.SlowConsumerPolicy = apps.SlowConsumerDisconnect
+	m, url := newTestManager(t, app)
+
+	// a client that stops reading once subscribed, so that the socket and
+	// then the send buffer fill up
+	ws, _, err := websocket.DefaultDialer.Dial(url+"/app/"+app.Key, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	var established protocol.Message
+	if err := ws.ReadJSON(&established); err != nil {
+		t.Fatal(err)
+	}
+	var data protocol.ConnectionEstablishedData
+	if err := json.Unmarshal([]byte(established.Data), &data); err != nil {
+		t.Fatal(err)
+	}
+	conn, _ := m.GetConnection(data.SocketID)
+
+	ws.WriteJSON(map[string]any{"event": protocol.EventSubscribe, "data": map[string]any{"channel": "lobby"}})
+	waitFor(t, func() bool { return conn.IsSubscribed("lobby") })
+
+	payload := `"` + strings.Repeat("x", 4096) + `"`
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for range 100000 {
+			select {
+			case <-conn.closing:
+				return
+			default:
+			}
+			m.PublishToChannel(t.Context(), app.ID, "lobby", "tick", payload, "", time.Now())
+		}
+	}()
+
+	select {
+	case <-published:
+	case <-time.After(10 * time.Second):
+		t.Fatal("publishing blocked on the slow consumer")
+	}
+
+	// the frames still buffered by the socket come first, then the close frame
+	for {
+		_, r, err := ws.NextReader()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != protocol.ErrorOverCapacity || closeErr.Text != "Send buffer full" {
+				t.Errorf("connection ended with %v, want close %d %q", err, protocol.ErrorOverCapacity, "Send buffer full")
+			}
+			break
+		}
+		io.Copy(io.Discard, r)
+	}
+
+	// the channel keeps working for the remaining subscribers
+	fast := dial(t, url, app)
+	fast.subscribe("lobby", nil)
+	m.PublishToChannel(t.Context(), app.ID, "lobby", "tick", `{}`, "", time.Now())
+	fast.expect("tick", "lobby")
+}
+
+// BenchmarkBroadcast compares sending an event to every subscriber with
+// SendMessage, which encodes and frames it once per subscriber, with the
+// broadcast path sharing one encoding and prepared frame between them. It
+// measures the publishing goroutine, writing the frames is left to the pumps.
+func BenchmarkBroadcast(b *testing.B) {
+	channelName := "lobby"
+	msg := &protocol.Message{Event: "price", Channel: &channelName, Data: `{"symbol":"PLS","bid":101.25,"ask":101.5,"volume":18250}`}
+
+	for _, subscribers := range []int{1000, 10000} {
+		m := NewManager(channel.NewManager(), nil, subscribers)
+		conns := make([]*Connection, subscribers)
+		for i := range conns {
+			conn := NewConnection(fmt.Sprintf("%d.%d", i, i), nil, m, m.activityTimeout)
+			conn.AppID = "app"
+			m.connections[conn.ID] = conn
+			m.channelManager.Subscribe("app", channelName, conn.ID)
+			conns[i] = conn
+		}
+
+		// drain empties the send buffers outside the timed part of b
+		drain := func(b *testing.B) {
+			b.StopTimer()
+			for _, conn := range conns {
+				<-conn.send
+			}
+			b.StartTimer()
+		}
+
+		b.Run(fmt.Sprintf("per_subscriber/%d", subscribers), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				for _, conn := range conns {
+					conn.SendMessage(msg)
+				}
+				drain(b)
+			}
+		})
+
+		b.Run(fmt.Sprintf("prepared/%d", subscribers), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				m.BroadcastToChannel("app", channelName, msg, "")
+				drain(b)
+			}
+		})
+
+		m.cancel()
+	}
+}
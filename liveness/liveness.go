@@ -0,0 +1,150 @@
+// Package liveness tracks which nodes of a cluster are alive. Every node
+// renews a heartbeat in a shared registry, and a node whose heartbeat expired
+// is claimed by exactly one other node, which cleans up after it.
+package liveness
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	HeartbeatInterval = 5 * time.Second
+	ReapInterval      = 10 * time.Second
+	// a node that has not sent a heartbeat for this long is considered dead
+	NodeTTL = 30 * time.Second
+
+	timeout = 5 * time.Second
+)
+
+// Registry stores the heartbeats of the nodes of a cluster
+type Registry interface {
+	// Beat renews the heartbeat of this node and reports whether it was
+	// missing, in which case another node may have claimed this one
+	Beat(ctx context.Context) (bool, error)
+
+	// Claim removes the heartbeats older than NodeTTL and returns the nodes
+	// this call removed, so no two nodes claim the same dead node
+	Claim(ctx context.Context) ([]string, error)
+
+	// Leave removes the heartbeat of this node
+	Leave(ctx context.Context) error
+}
+
+// Handlers clean up after dead nodes and take back the state of this node
+type Handlers struct {
+	// Restore is called when the heartbeat of this node was missing, it adds
+	// back what other nodes removed when they mistook this one for dead
+	Restore func(ctx context.Context)
+
+	// Reap is called with the dead nodes claimed by this node
+	Reap func(ctx context.Context, nodeIDs []string)
+}
+
+// Tracker renews the heartbeat of this node and reaps dead nodes in the background
+type Tracker struct {
+	name     string
+	registry Registry
+	handlers Handlers
+	beaten   bool
+	mu       sync.Mutex // serializes beats and reaps
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// Start sends the first heartbeat and starts the background loop, name
+// identifies the registry in logs
+func Start(name string, registry Registry, handlers Handlers) *Tracker {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	t := &Tracker{
+		name:     name,
+		registry: registry,
+		handlers: handlers,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	t.Beat()
+
+	t.wg.Add(1)
+	go t.run()
+
+	return t
+}
+
+func (t *Tracker) run() {
+	defer t.wg.Done()
+
+	heartbeat := time.NewTicker(HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	reap := time.NewTicker(ReapInterval)
+	defer reap.Stop()
+
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-heartbeat.C:
+			t.Beat()
+		case <-reap.C:
+			t.Reap()
+		}
+	}
+}
+
+// Beat renews the heartbeat, restoring this node's state when it was missing.
+// The heartbeat is always missing the first time, so that one is skipped.
+func (t *Tracker) Beat() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(t.ctx, timeout)
+	defer cancel()
+
+	missing, err := t.registry.Beat(ctx)
+	if err != nil {
+		log.Warn("failed to send heartbeat", "registry", t.name, "error", err)
+		return
+	}
+
+	if missing && t.beaten && t.handlers.Restore != nil {
+		t.handlers.Restore(ctx)
+	}
+	t.beaten = true
+}
+
+// Reap claims the nodes whose heartbeat expired and cleans up after them
+func (t *Tracker) Reap() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(t.ctx, timeout)
+	defer cancel()
+
+	dead, err := t.registry.Claim(ctx)
+	if err != nil {
+		log.Warn("failed to look up dead nodes", "registry", t.name, "error", err)
+		return
+	}
+
+	if len(dead) > 0 && t.handlers.Reap != nil {
+		t.handlers.Reap(ctx, dead)
+	}
+}
+
+// Stop ends the background loop and removes the heartbeat of this node
+func (t *Tracker) Stop() error {
+	t.cancel()
+	t.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return t.registry.Leave(ctx)
+}
@@ -0,0 +1,97 @@
+package liveness
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestClient(t *testing.T) *redis.Client {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// expire makes the heartbeat of nodeID older than NodeTTL
+func expire(t *testing.T, client *redis.Client, nodeID string) {
+	t.Helper()
+
+	if err := client.ZAdd(t.Context(), "nodes", redis.Z{Score: 0, Member: nodeID}).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recorder collects the calls of the handlers of a tracker
+type recorder struct {
+	restored int
+	reaped   []string
+}
+
+func (r *recorder) handlers() Handlers {
+	return Handlers{
+		Restore: func(ctx context.Context) { r.restored++ },
+		Reap:    func(ctx context.Context, nodeIDs []string) { r.reaped = append(r.reaped, nodeIDs...) },
+	}
+}
+
+func TestRedisClaimsDeadNodesOnce(t *testing.T) {
+	client := newTestClient(t)
+
+	var a, b recorder
+	trackerA := Start("test", NewRedis(client, "nodes", "node-a"), a.handlers())
+	trackerB := Start("test", NewRedis(client, "nodes", "node-b"), b.handlers())
+	defer trackerB.Stop()
+
+	// a node with an expired heartbeat does not claim itself
+	expire(t, client, "node-b")
+	trackerB.Reap()
+	trackerA.Reap()
+	if !slices.Equal(a.reaped, []string{"node-b"}) || len(b.reaped) != 0 {
+		t.Fatalf("node a reaped %v, node b reaped %v, want node a to claim node b only", a.reaped, b.reaped)
+	}
+
+	trackerA.Reap()
+	if len(a.reaped) != 1 {
+		t.Errorf("node a reaped %v, want node b claimed once", a.reaped)
+	}
+
+	if err := trackerA.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if ids := client.ZRange(t.Context(), "nodes", 0, -1).Val(); slices.Contains(ids, "node-a") {
+		t.Errorf("heartbeats = %v after node a stopped, want node a removed", ids)
+	}
+}
+
+func TestTrackerRestoresAfterMissingHeartbeat(t *testing.T) {
+	client := newTestClient(t)
+
+	var r recorder
+	tracker := Start("test", NewRedis(client, "nodes", "node-a"), r.handlers())
+	defer tracker.Stop()
+
+	// the first heartbeat is always missing
+	if r.restored != 0 {
+		t.Fatalf("restored %d times on start, want 0", r.restored)
+	}
+
+	tracker.Beat()
+	if r.restored != 0 {
+		t.Fatalf("restored %d times while the heartbeat was kept, want 0", r.restored)
+	}
+
+	// another node claimed this one
+	if err := client.ZRem(t.Context(), "nodes", "node-a").Err(); err != nil {
+		t.Fatal(err)
+	}
+	tracker.Beat()
+	if r.restored != 1 {
+		t.Errorf("restored %d times after the heartbeat was claimed, want 1", r.restored)
+	}
+}
@@ -0,0 +1,85 @@
+package liveness
+
+import (
+	"context"
+	"encoding/base64"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// KeyValue keeps heartbeats as keys of a JetStream key value bucket, renewed
+// with compare and swap. The bucket only knows when a key was last written,
+// so a heartbeat expires when its key stops changing. Deleting the key at its
+// last revision claims the node.
+type KeyValue struct {
+	kv     jetstream.KeyValue
+	prefix string
+	nodeID string
+	rev    uint64 // revision of this node's heartbeat key
+}
+
+// NewKeyValue stores heartbeats under prefix, which must be a single key token
+func NewKeyValue(kv jetstream.KeyValue, prefix, nodeID string) *KeyValue {
+	return &KeyValue{kv: kv, prefix: prefix, nodeID: nodeID}
+}
+
+// key encodes the node id as a single key token, node ids may contain dots
+func (k *KeyValue) key(nodeID string) string {
+	return k.prefix + "." + base64.RawURLEncoding.EncodeToString([]byte(nodeID))
+}
+
+func (k *KeyValue) Beat(ctx context.Context) (bool, error) {
+	key := k.key(k.nodeID)
+	if k.rev != 0 {
+		rev, err := k.kv.Update(ctx, key, []byte(k.nodeID), k.rev)
+		if err == nil {
+			k.rev = rev
+			return false, nil
+		}
+	}
+
+	rev, err := k.kv.Create(ctx, key, []byte(k.nodeID))
+	if err != nil {
+		return false, err
+	}
+	k.rev = rev
+	return true, nil
+}
+
+func (k *KeyValue) Claim(ctx context.Context) ([]string, error) {
+	lister, err := k.kv.ListKeysFiltered(ctx, k.prefix+".*")
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for key := range lister.Keys() {
+		keys = append(keys, key)
+	}
+
+	var claimed []string
+	for _, key := range keys {
+		entry, err := k.kv.Get(ctx, key)
+		if err != nil || time.Since(entry.Created()) < NodeTTL {
+			continue
+		}
+
+		nodeID := string(entry.Value())
+		if nodeID == k.nodeID {
+			continue
+		}
+		if err := k.kv.Delete(ctx, key, jetstream.LastRevision(entry.Revision())); err != nil {
+			continue
+		}
+		claimed = append(claimed, nodeID)
+	}
+	return claimed, nil
+}
+
+func (k *KeyValue) Leave(ctx context.Context) error {
+	if k.rev == 0 {
+		return nil
+	}
+	return k.kv.Delete(ctx, k.key(k.nodeID), jetstream.LastRevision(k.rev))
+}
@@ -0,0 +1,58 @@
+package liveness
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis keeps heartbeats in a sorted set scored by their time. Removing a
+// node from the set claims it.
+type Redis struct {
+	client *redis.Client
+	key    string
+	nodeID string
+}
+
+func NewRedis(client *redis.Client, key, nodeID string) *Redis {
+	return &Redis{client: client, key: key, nodeID: nodeID}
+}
+
+func (r *Redis) Beat(ctx context.Context) (bool, error) {
+	added, err := r.client.ZAdd(ctx, r.key, redis.Z{
+		Score:  float64(time.Now().UnixMilli()),
+		Member: r.nodeID,
+	}).Result()
+	return added == 1, err
+}
+
+func (r *Redis) Claim(ctx context.Context) ([]string, error) {
+	deadline := time.Now().Add(-NodeTTL).UnixMilli()
+	expired, err := r.client.ZRangeByScore(ctx, r.key, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: "(" + strconv.FormatInt(deadline, 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var claimed []string
+	for _, nodeID := range expired {
+		if nodeID == r.nodeID {
+			continue
+		}
+
+		removed, err := r.client.ZRem(ctx, r.key, nodeID).Result()
+		if err != nil || removed == 0 {
+			continue
+		}
+		claimed = append(claimed, nodeID)
+	}
+	return claimed, nil
+}
+
+func (r *Redis) Leave(ctx context.Context) error {
+	return r.client.ZRem(ctx, r.key, r.nodeID).Err()
+}
@@ -14,6 +14,7 @@ import (
 
 	"github.com/aelpxy/pulse/metrics"
 	"github.com/aelpxy/pulse/server"
+	"github.com/aelpxy/pulse/tracing"
 	"github.com/charmbracelet/log"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -23,6 +24,7 @@ func main() {
 	port := flag.String("port", "", "server port (overrides config file)")
 	maxConns := flag.Int("max-connections", 100000, "maximum concurrent connections")
 	debugFlag := flag.Bool("debug", false, "enable debug logging (overrides config file)")
+	watchConfig := flag.Bool("watch-config", false, "reload apps when the config file changes")
 	flag.Parse()
 
 	configPath := *configFile
@@ -51,6 +53,14 @@ func main() {
 		log.Info("debug mode disabled")
 	}
 
+	shutdownTracing, err := tracing.Setup(context.Background(), serverConfig.Tracing)
+	if err != nil {
+		log.Fatal("failed to set up tracing", "error", err)
+	}
+	if serverConfig.Tracing.Enabled {
+		log.Info("tracing enabled", "endpoint", serverConfig.Tracing.Endpoint)
+	}
+
 	serverPort := *port
 	if serverPort == "" {
 		serverPort = getEnv("PULSE_PORT", "")
@@ -73,6 +83,24 @@ func main() {
 				srv.HandleEvents(w, r)
 			case "batch_events":
 				srv.HandleBatchEvents(w, r)
+			case "channels":
+				if len(parts) == 3 {
+					srv.HandleChannels(w, r)
+				} else if len(parts) == 4 {
+					srv.HandleChannel(w, r)
+				} else if len(parts) == 5 && parts[4] == "users" {
+					srv.HandleChannelUsers(w, r)
+				} else {
+					http.Error(w, "Not found", http.StatusNotFound)
+				}
+			case "users":
+				if len(parts) == 5 && parts[4] == "events" {
+					srv.HandleUserEvents(w, r)
+				} else if len(parts) == 5 && parts[4] == "terminate_connections" {
+					srv.HandleTerminateUserConnections(w, r)
+				} else {
+					http.Error(w, "Not found", http.StatusNotFound)
+				}
 			default:
 				http.Error(w, "Not found", http.StatusNotFound)
 			}
@@ -89,8 +117,30 @@ func main() {
 		fmt.Fprintf(w, "OK")
 	})
 
+	var adminServer *http.Server
+	if admin := serverConfig.Admin; admin.Token != "" {
+		if admin.Port == "" {
+			http.Handle("/admin/", srv.AdminHandler(admin.Token))
+			log.Info("admin api enabled", "port", serverPort)
+		} else {
+			adminServer = &http.Server{
+				Addr:         ":" + admin.Port,
+				Handler:      server.TraceHTTP(server.InstrumentHTTP(srv.AdminHandler(admin.Token))),
+				ReadTimeout:  60 * time.Second,
+				WriteTimeout: 60 * time.Second,
+			}
+			go func() {
+				log.Info("admin api starting", "port", admin.Port)
+				if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					log.Fatal("admin server error", "error", err)
+				}
+			}()
+		}
+	}
+
 	httpServer := &http.Server{
 		Addr:         ":" + serverPort,
+		Handler:      server.TraceHTTP(server.InstrumentHTTP(http.DefaultServeMux)),
 		ReadTimeout:  60 * time.Second,
 		WriteTimeout: 60 * time.Second,
 		IdleTimeout:  120 * time.Second,
@@ -106,11 +156,32 @@ func main() {
 		}
 	}()
 
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			log.Info("received SIGHUP, reloading apps", "path", configPath)
+			if err := srv.ReloadApps(configPath); err != nil {
+				log.Error("failed to reload apps", "error", err)
+			}
+		}
+	}()
+
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	if *watchConfig {
+		go func() {
+			if err := srv.WatchConfig(watchCtx, configPath); err != nil {
+				log.Error("config watcher stopped", "error", err)
+			}
+		}()
+	}
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
 	log.Info("shutting down server...")
+	stopWatching()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -119,10 +190,20 @@ func main() {
 		log.Error("http server shutdown error", "error", err)
 	}
 
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			log.Error("admin server shutdown error", "error", err)
+		}
+	}
+
 	if err := srv.Shutdown(10 * time.Second); err != nil {
 		log.Error("pulse server shutdown error", "error", err)
 	}
 
+	if err := shutdownTracing(ctx); err != nil {
+		log.Error("tracing shutdown error", "error", err)
+	}
+
 	log.Info("server stopped")
 }
 
@@ -44,6 +44,11 @@ var (
 		Help: "Total number of messages sent to clients",
 	}, []string{"app_key"})
 
+	MessagesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pulse_messages_dropped_total",
+		Help: "Total number of messages dropped because a client's send buffer was full",
+	}, []string{"app_key", "policy"})
+
 	MessageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "pulse_message_errors_total",
 		Help: "Total number of message errors",
@@ -67,14 +72,29 @@ var (
 		Help: "Number of apps loaded from configuration",
 	})
 
-	// performance metrics
+	// performance metrics, observed when an event triggered through the HTTP
+	// API or by a client is written to a subscriber
 	MessageLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "pulse_message_latency_seconds",
-		Help:    "Message processing latency in seconds",
-		Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1},
-	}, []string{"app_key", "event_type"})
+		Help:    "Time from receiving an event until it is written to a client in seconds",
+		Buckets: latencyBuckets,
+	}, []string{"app_key", "channel_type"})
+
+	MessageQueueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pulse_message_queue_wait_seconds",
+		Help:    "Time an event waits in a client's send buffer in seconds",
+		Buckets: latencyBuckets,
+	}, []string{"app_key", "channel_type"})
+
+	MessageWriteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pulse_message_write_duration_seconds",
+		Help:    "Time to write an event to a client's socket in seconds",
+		Buckets: latencyBuckets,
+	}, []string{"app_key", "channel_type"})
 )
 
+var latencyBuckets = []float64{.0001, .0005, .001, .005, .01, .025, .05, .1, .25, .5, 1}
+
 func GetChannelType(channelName string) string {
 	if len(channelName) > 8 && channelName[:8] == "private-" {
 		return "private"
@@ -0,0 +1,363 @@
+package presence
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/aelpxy/pulse/liveness"
+	"github.com/charmbracelet/log"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// natsUser is the value stored for every user of a presence channel
+type natsUser struct {
+	UserInfo    map[string]any `json:"user_info,omitempty"`
+	Connections []string       `json:"connections"` // member fields of the user's connections
+}
+
+// NATSStore shares presence members between the nodes of a cluster through a
+// JetStream key value bucket. Every user of a channel has a key listing its
+// connections on all nodes, updated with compare and swap so that user
+// transitions are reported by exactly one node.
+//
+// Nodes keep a heartbeat key up to date. Members of a node whose key stops
+// changing are removed by whichever node deletes the key first.
+type NATSStore struct {
+	kv        jetstream.KeyValue
+	nodeID    string
+	local     map[localKey]*Member
+	localMux  sync.RWMutex
+	onReap    func(appID, channelName string, member *Member)
+	onRestore func(appID, channelName string, member *Member)
+	liveness  *liveness.Tracker
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// NewNATSStore starts the heartbeat of nodeID in a bucket shared with the
+// other nodes, usually the one of the NATS adapter
+func NewNATSStore(kv jetstream.KeyValue, nodeID string) *NATSStore {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &NATSStore{
+		kv:     kv,
+		nodeID: nodeID,
+		local:  make(map[localKey]*Member),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	s.liveness = liveness.Start("presence", liveness.NewKeyValue(kv, "presence-nodes", nodeID), liveness.Handlers{
+		Restore: s.restore,
+		Reap:    s.reapNodes,
+	})
+
+	return s
+}
+
+// natsToken encodes a name for use as a single key token, channel names
+// may contain dots which would otherwise split the key
+func natsToken(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+func (s *NATSStore) channelKeys(appID, channelName string) string {
+	return "presence." + natsToken(appID) + "." + natsToken(channelName) + ".*"
+}
+
+func (s *NATSStore) userKey(appID, channelName, userID string) string {
+	return "presence." + natsToken(appID) + "." + natsToken(channelName) + "." + natsToken(userID)
+}
+
+// parseUserKey returns the app, channel and user a user key belongs to
+func parseUserKey(key string) (appID, channelName, userID string, ok bool) {
+	parts := strings.Split(key, ".")
+	if len(parts) != 4 || parts[0] != "presence" {
+		return "", "", "", false
+	}
+
+	decoded := make([]string, 3)
+	for i, part := range parts[1:] {
+		value, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			return "", "", "", false
+		}
+		decoded[i] = string(value)
+	}
+	return decoded[0], decoded[1], decoded[2], true
+}
+
+// SetReapHandler implements Reaper
+func (s *NATSStore) SetReapHandler(handler func(appID, channelName string, member *Member)) {
+	s.onReap = handler
+}
+
+// SetRestoreHandler implements Reaper
+func (s *NATSStore) SetRestoreHandler(handler func(appID, channelName string, member *Member)) {
+	s.onRestore = handler
+}
+
+func (s *NATSStore) AddMember(appID, channelName, connectionID string, member *Member) (bool, error) {
+	s.localMux.Lock()
+	s.local[localKey{appID, channelName, connectionID}] = member
+	s.localMux.Unlock()
+
+	ctx, cancel := context.WithTimeout(s.ctx, storeTimeout)
+	defer cancel()
+
+	joined, err := s.add(ctx, appID, channelName, connectionID, member)
+	if err != nil {
+		return false, fmt.Errorf("failed to add presence member: %w", err)
+	}
+	return joined, nil
+}
+
+// add stores a member of this node and reports whether it is the user's first connection
+func (s *NATSStore) add(ctx context.Context, appID, channelName, connectionID string, member *Member) (bool, error) {
+	field := memberField(s.nodeID, connectionID)
+
+	before, _, err := s.updateUser(ctx, s.userKey(appID, channelName, member.UserID), func(user *natsUser) {
+		user.UserInfo = member.UserInfo
+		if !slices.Contains(user.Connections, field) {
+			user.Connections = append(user.Connections, field)
+		}
+	})
+	return before == 0, err
+}
+
+func (s *NATSStore) RemoveMember(appID, channelName, connectionID string) (*Member, bool) {
+	key := localKey{appID, channelName, connectionID}
+
+	s.localMux.Lock()
+	member, exists := s.local[key]
+	delete(s.local, key)
+	s.localMux.Unlock()
+
+	if !exists {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, storeTimeout)
+	defer cancel()
+
+	field := memberField(s.nodeID, connectionID)
+	before, after, err := s.updateUser(ctx, s.userKey(appID, channelName, member.UserID), func(user *natsUser) {
+		user.Connections = slices.DeleteFunc(user.Connections, func(f string) bool { return f == field })
+	})
+	if err != nil {
+		log.Error("failed to remove presence member", "app", appID, "channel", channelName, "error", err)
+		return nil, false
+	}
+	// already removed by a node that mistook this one for dead
+	if before == after {
+		return nil, false
+	}
+	return member, after == 0
+}
+
+// updateUser changes the stored user, retrying when another node changed it
+// concurrently. The key is deleted once the user has no connections left. It
+// returns the user's connection count before and after the update.
+func (s *NATSStore) updateUser(ctx context.Context, key string, update func(user *natsUser)) (int, int, error) {
+	for {
+		var user natsUser
+		var rev uint64
+
+		entry, err := s.kv.Get(ctx, key)
+		switch {
+		case errors.Is(err, jetstream.ErrKeyNotFound):
+		case err != nil:
+			return 0, 0, err
+		default:
+			rev = entry.Revision()
+			if err := json.Unmarshal(entry.Value(), &user); err != nil {
+				return 0, 0, err
+			}
+		}
+
+		before := len(user.Connections)
+		update(&user)
+		after := len(user.Connections)
+
+		switch {
+		case after == 0 && rev == 0:
+			return before, after, nil
+		case after == 0:
+			err = s.kv.Delete(ctx, key, jetstream.LastRevision(rev))
+		case rev == 0:
+			data, _ := json.Marshal(&user)
+			_, err = s.kv.Create(ctx, key, data)
+		default:
+			data, _ := json.Marshal(&user)
+			_, err = s.kv.Update(ctx, key, data, rev)
+		}
+
+		if errors.Is(err, jetstream.ErrKeyExists) || errors.Is(err, jetstream.ErrKeyRevisionMismatch) {
+			continue
+		}
+		return before, after, err
+	}
+}
+
+// users loads every user of a channel
+func (s *NATSStore) users(appID, channelName string) map[string]*natsUser {
+	ctx, cancel := context.WithTimeout(s.ctx, storeTimeout)
+	defer cancel()
+
+	keys, err := s.listKeys(ctx, s.channelKeys(appID, channelName))
+	if err != nil {
+		log.Error("failed to load presence users", "app", appID, "channel", channelName, "error", err)
+		return nil
+	}
+
+	users := make(map[string]*natsUser, len(keys))
+	for _, key := range keys {
+		_, _, userID, ok := parseUserKey(key)
+		if !ok {
+			continue
+		}
+
+		entry, err := s.kv.Get(ctx, key)
+		if err != nil {
+			continue
+		}
+
+		var user natsUser
+		if err := json.Unmarshal(entry.Value(), &user); err != nil || len(user.Connections) == 0 {
+			continue
+		}
+		users[userID] = &user
+	}
+	return users
+}
+
+func (s *NATSStore) listKeys(ctx context.Context, filter string) ([]string, error) {
+	lister, err := s.kv.ListKeysFiltered(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for key := range lister.Keys() {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s *NATSStore) GetPresenceData(appID, channelName string) *PresenceData {
+	data := &PresenceData{
+		IDs:  []string{},
+		Hash: make(map[string]map[string]any),
+	}
+
+	for userID, user := range s.users(appID, channelName) {
+		data.IDs = append(data.IDs, userID)
+		if user.UserInfo != nil {
+			data.Hash[userID] = user.UserInfo
+		}
+	}
+	data.Count = len(data.IDs)
+	return data
+}
+
+func (s *NATSStore) GetUserCount(appID, channelName string) int {
+	return len(s.users(appID, channelName))
+}
+
+func (s *NATSStore) GetUserIDs(appID, channelName string) []string {
+	ids := []string{}
+	for userID := range s.users(appID, channelName) {
+		ids = append(ids, userID)
+	}
+	return ids
+}
+
+// GetMember only returns members of connections on this node
+func (s *NATSStore) GetMember(appID, channelName, connectionID string) (*Member, bool) {
+	s.localMux.RLock()
+	defer s.localMux.RUnlock()
+	member, exists := s.local[localKey{appID, channelName, connectionID}]
+	return member, exists
+}
+
+// restore adds the members of this node's connections back and reports the
+// users that rejoined. The lock is held throughout so a member removed
+// meanwhile is not restored after its removal.
+func (s *NATSStore) restore(ctx context.Context) {
+	s.localMux.RLock()
+	defer s.localMux.RUnlock()
+
+	if len(s.local) == 0 {
+		return
+	}
+
+	log.Warn("presence heartbeat was missing, restoring members of this node", "node", s.nodeID, "members", len(s.local))
+	for key, member := range s.local {
+		joined, err := s.add(ctx, key.appID, key.channelName, key.connectionID, member)
+		if err != nil {
+			log.Error("failed to restore presence member", "app", key.appID, "channel", key.channelName, "user", member.UserID, "error", err)
+			continue
+		}
+		if joined && s.onRestore != nil {
+			s.onRestore(key.appID, key.channelName, member)
+		}
+	}
+}
+
+// reapNodes removes the members of dead nodes claimed by this one
+func (s *NATSStore) reapNodes(ctx context.Context, nodeIDs []string) {
+	dead := make(map[string]bool, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		dead[nodeID] = true
+	}
+
+	keys, err := s.listKeys(ctx, "presence.>")
+	if err != nil {
+		log.Warn("failed to load members of dead nodes", "error", err)
+		return
+	}
+
+	left := 0
+	for _, key := range keys {
+		appID, channelName, userID, ok := parseUserKey(key)
+		if !ok {
+			continue
+		}
+
+		var userInfo map[string]any
+		before, after, err := s.updateUser(ctx, key, func(user *natsUser) {
+			userInfo = user.UserInfo
+			user.Connections = slices.DeleteFunc(user.Connections, func(field string) bool {
+				nodeID, _, _ := strings.Cut(field, "|")
+				return dead[nodeID]
+			})
+		})
+		if err != nil {
+			log.Warn("failed to remove presence members of dead node", "app", appID, "channel", channelName, "error", err)
+			continue
+		}
+
+		if before > 0 && after == 0 {
+			left++
+			if s.onReap != nil {
+				s.onReap(appID, channelName, &Member{UserID: userID, UserInfo: userInfo})
+			}
+		}
+	}
+
+	log.Info("removed presence members of dead nodes", "nodes", len(dead), "users", left)
+}
+
+// Close stops the heartbeat and deregisters this node, its members are
+// expected to have been removed as its connections closed
+func (s *NATSStore) Close() error {
+	err := s.liveness.Stop()
+	s.cancel()
+	return err
+}
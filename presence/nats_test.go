@@ -0,0 +1,160 @@
+package presence
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// newTestBucket starts an embedded nats server with jetstream and returns a
+// bucket on it
+func newTestBucket(t *testing.T) jetstream.KeyValue {
+	t.Helper()
+
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir(), NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.Start()
+	t.Cleanup(ns.Shutdown)
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+
+	conn, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err := js.CreateKeyValue(t.Context(), jetstream.KeyValueConfig{Bucket: "pulse", Storage: jetstream.MemoryStorage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
+func newTestNATSStore(t *testing.T, kv jetstream.KeyValue, nodeID string) *NATSStore {
+	t.Helper()
+
+	s := NewNATSStore(kv, nodeID)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestNATSStoreSharesUsers(t *testing.T) {
+	kv := newTestBucket(t)
+	a := newTestNATSStore(t, kv, "node-a")
+	b := newTestNATSStore(t, kv, "node-b")
+
+	alice := &Member{UserID: "alice", UserInfo: map[string]any{"name": "Alice"}}
+	joinedA, errA := a.AddMember("app", "presence-lobby.eu", "a.1", alice)
+	joinedB, errB := b.AddMember("app", "presence-lobby.eu", "b.1", alice)
+	if errA != nil || errB != nil {
+		t.Fatalf("AddMember: %v, %v", errA, errB)
+	}
+	if joinedA == joinedB || !joinedA {
+		t.Fatalf("AddMember on node a = %v, node b = %v, want exactly one true for the first connection", joinedA, joinedB)
+	}
+	b.AddMember("app", "presence-lobby.eu", "b.2", &Member{UserID: "bob"})
+	a.AddMember("other", "presence-lobby.eu", "a.2", &Member{UserID: "carol"})
+
+	for _, s := range []*NATSStore{a, b} {
+		ids := s.GetUserIDs("app", "presence-lobby.eu")
+		slices.Sort(ids)
+		if !slices.Equal(ids, []string{"alice", "bob"}) {
+			t.Errorf("%s users = %v, want [alice bob]", s.nodeID, ids)
+		}
+		if data := s.GetPresenceData("app", "presence-lobby.eu"); data.Count != 2 || data.Hash["alice"]["name"] != "Alice" {
+			t.Errorf("%s presence data = %+v, want alice and bob", s.nodeID, data)
+		}
+	}
+
+	member, left := a.RemoveMember("app", "presence-lobby.eu", "a.1")
+	if member == nil || left {
+		t.Fatalf("RemoveMember on node a = %v, %v, want alice to stay connected on node b", member, left)
+	}
+	member, left = b.RemoveMember("app", "presence-lobby.eu", "b.1")
+	if member == nil || !left || member.UserID != "alice" {
+		t.Fatalf("RemoveMember on node b = %v, %v, want alice to leave", member, left)
+	}
+	if count := a.GetUserCount("app", "presence-lobby.eu"); count != 1 {
+		t.Errorf("user count = %d, want 1", count)
+	}
+}
+
+func TestNATSStoreReapsDeadNode(t *testing.T) {
+	kv := newTestBucket(t)
+	dead := newTestNATSStore(t, kv, "node-a")
+	live := newTestNATSStore(t, kv, "node-b")
+
+	var got []*Member
+	live.SetReapHandler(func(appID, channelName string, member *Member) {
+		if appID != "app" || channelName != "presence-lobby" {
+			t.Errorf("reaped a member of %s %s", appID, channelName)
+		}
+		got = append(got, member)
+	})
+
+	dead.AddMember("app", "presence-lobby", "a.1", &Member{UserID: "alice"})
+	dead.AddMember("app", "presence-lobby", "a.2", &Member{UserID: "bob"})
+	live.AddMember("app", "presence-lobby", "b.1", &Member{UserID: "bob"})
+
+	// the key value store only knows when a heartbeat was written, so the
+	// node is reaped as if its heartbeat had expired
+	live.reapNodes(t.Context(), []string{"node-a"})
+
+	// bob is still connected to the live node, so only alice left
+	if len(got) != 1 || got[0].UserID != "alice" {
+		t.Fatalf("reap handler called with %v, want alice once", got)
+	}
+	if ids := live.GetUserIDs("app", "presence-lobby"); !slices.Equal(ids, []string{"bob"}) {
+		t.Errorf("users = %v, want [bob]", ids)
+	}
+}
+
+func TestNATSStoreRestoresReapedMembers(t *testing.T) {
+	kv := newTestBucket(t)
+	a := newTestNATSStore(t, kv, "node-a")
+	b := newTestNATSStore(t, kv, "node-b")
+
+	type restored struct {
+		appID, channelName, userID string
+	}
+	var got []restored
+	a.SetRestoreHandler(func(appID, channelName string, member *Member) {
+		got = append(got, restored{appID, channelName, member.UserID})
+	})
+
+	a.AddMember("app", "presence-lobby", "a.1", &Member{UserID: "alice"})
+
+	// claiming node a deletes its heartbeat key
+	if err := kv.Delete(t.Context(), "presence-nodes."+natsToken("node-a")); err != nil {
+		t.Fatal(err)
+	}
+	b.reapNodes(t.Context(), []string{"node-a"})
+	if count := b.GetUserCount("app", "presence-lobby"); count != 0 {
+		t.Fatalf("user count = %d after reaping, want 0", count)
+	}
+
+	a.liveness.Beat()
+	if ids := b.GetUserIDs("app", "presence-lobby"); !slices.Equal(ids, []string{"alice"}) {
+		t.Fatalf("users = %v after the heartbeat, want [alice]", ids)
+	}
+	// clients of other nodes saw alice leave, so she has to join again
+	if len(got) != 1 || got[0] != (restored{"app", "presence-lobby", "alice"}) {
+		t.Errorf("restore handler called with %+v, want alice rejoining app presence-lobby once", got)
+	}
+
+	if _, left := a.RemoveMember("app", "presence-lobby", "a.1"); !left {
+		t.Error("alice did not leave with the restored connection")
+	}
+}
@@ -11,28 +11,54 @@ type Member struct {
 }
 
 type ChannelMembers struct {
-	members map[string]*Member
+	members map[string]*Member // connection id -> member
+	users   map[string]int     // user id -> connection count
 	mu      sync.RWMutex
 }
 
 func NewChannelMembers() *ChannelMembers {
 	return &ChannelMembers{
 		members: make(map[string]*Member),
+		users:   make(map[string]int),
 	}
 }
 
-func (c *ChannelMembers) Add(connectionID string, member *Member) {
+// Add stores the member for a connection and reports whether this is the
+// first connection of that user in the channel
+func (c *ChannelMembers) Add(connectionID string, member *Member) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+
+	if existing, exists := c.members[connectionID]; exists {
+		c.release(existing.UserID)
+	}
 	c.members[connectionID] = member
+	c.users[member.UserID]++
+	return c.users[member.UserID] == 1
 }
 
-func (c *ChannelMembers) Remove(connectionID string) *Member {
+// Remove deletes the member of a connection and reports whether it was the
+// last connection of that user in the channel
+func (c *ChannelMembers) Remove(connectionID string) (*Member, bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	member := c.members[connectionID]
+
+	member, exists := c.members[connectionID]
+	if !exists {
+		return nil, false
+	}
 	delete(c.members, connectionID)
-	return member
+	return member, c.release(member.UserID)
+}
+
+// release must be called with c.mu held
+func (c *ChannelMembers) release(userID string) bool {
+	if c.users[userID] <= 1 {
+		delete(c.users, userID)
+		return true
+	}
+	c.users[userID]--
+	return false
 }
 
 func (c *ChannelMembers) Get(connectionID string) (*Member, bool) {
@@ -79,6 +105,25 @@ func (c *ChannelMembers) GetPresenceData() *PresenceData {
 	}
 }
 
+// UserCount returns the number of unique users, a user may hold several connections
+func (c *ChannelMembers) UserCount() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.users)
+}
+
+// UserIDs returns the unique user ids of the channel members
+func (c *ChannelMembers) UserIDs() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ids := make([]string, 0, len(c.users))
+	for userID := range c.users {
+		ids = append(ids, userID)
+	}
+	return ids
+}
+
 func (c *ChannelMembers) Count() int {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -91,46 +136,84 @@ type PresenceData struct {
 	Count int                       `json:"count"`
 }
 
+// Store holds the presence members of every app channel. AddMember and
+// RemoveMember report user level transitions so member_added and
+// member_removed are sent once per user, however many connections it holds.
+type Store interface {
+	AddMember(appID, channelName, connectionID string, member *Member) (bool, error)
+	RemoveMember(appID, channelName, connectionID string) (*Member, bool)
+	GetPresenceData(appID, channelName string) *PresenceData
+	GetUserCount(appID, channelName string) int
+	GetUserIDs(appID, channelName string) []string
+	GetMember(appID, channelName, connectionID string) (*Member, bool)
+}
+
+// Reaper is implemented by stores shared between nodes, which remove the
+// members of nodes that stopped and report users that left as a result. A
+// node mistaken for dead adds its members back and reports the users that
+// rejoined.
+type Reaper interface {
+	SetReapHandler(handler func(appID, channelName string, member *Member))
+	SetRestoreHandler(handler func(appID, channelName string, member *Member))
+}
+
+// Manager is the in-memory Store used by a single node
 type Manager struct {
-	channels map[string]*ChannelMembers
-	mu       sync.RWMutex
+	apps map[string]map[string]*ChannelMembers // app id -> channel name -> members
+	mu   sync.RWMutex
 }
 
 func NewManager() *Manager {
 	return &Manager{
-		channels: make(map[string]*ChannelMembers),
+		apps: make(map[string]map[string]*ChannelMembers),
 	}
 }
 
-func (m *Manager) AddMember(channelName, connectionID string, member *Member) {
+// AddMember reports whether the member's user joined the channel with this connection
+func (m *Manager) AddMember(appID, channelName, connectionID string, member *Member) (bool, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if _, exists := m.channels[channelName]; !exists {
-		m.channels[channelName] = NewChannelMembers()
+	channels, exists := m.apps[appID]
+	if !exists {
+		channels = make(map[string]*ChannelMembers)
+		m.apps[appID] = channels
 	}
-	m.channels[channelName].Add(connectionID, member)
+	if _, exists := channels[channelName]; !exists {
+		channels[channelName] = NewChannelMembers()
+	}
+	return channels[channelName].Add(connectionID, member), nil
 }
 
-func (m *Manager) RemoveMember(channelName, connectionID string) *Member {
+// RemoveMember returns the removed member and reports whether its user left
+// the channel, i.e. no other connection of that user remains subscribed
+func (m *Manager) RemoveMember(appID, channelName, connectionID string) (*Member, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if ch, exists := m.channels[channelName]; exists {
-		member := ch.Remove(connectionID)
+	channels, exists := m.apps[appID]
+	if !exists {
+		return nil, false
+	}
+
+	if ch, exists := channels[channelName]; exists {
+		member, userLeft := ch.Remove(connectionID)
 		if ch.Count() == 0 {
-			delete(m.channels, channelName)
+			delete(channels, channelName)
+			if len(channels) == 0 {
+				delete(m.apps, appID)
+			}
 		}
-		return member
+		return member, userLeft
 	}
-	return nil
+	return nil, false
 }
 
-func (m *Manager) GetPresenceData(channelName string) *PresenceData {
+func (m *Manager) GetPresenceData(appID, channelName string) *PresenceData {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	if ch, exists := m.channels[channelName]; exists {
+	if ch, exists := m.apps[appID][channelName]; exists {
 		return ch.GetPresenceData()
 	}
 	return &PresenceData{
@@ -140,11 +223,31 @@ func (m *Manager) GetPresenceData(channelName string) *PresenceData {
 	}
 }
 
-func (m *Manager) GetMember(channelName, connectionID string) (*Member, bool) {
+func (m *Manager) GetUserCount(appID, channelName string) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if ch, exists := m.apps[appID][channelName]; exists {
+		return ch.UserCount()
+	}
+	return 0
+}
+
+func (m *Manager) GetUserIDs(appID, channelName string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if ch, exists := m.apps[appID][channelName]; exists {
+		return ch.UserIDs()
+	}
+	return []string{}
+}
+
+func (m *Manager) GetMember(appID, channelName, connectionID string) (*Member, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	if ch, exists := m.channels[channelName]; exists {
+	if ch, exists := m.apps[appID][channelName]; exists {
 		return ch.Get(connectionID)
 	}
 	return nil, false
@@ -0,0 +1,92 @@
+package presence
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestManagerIsolatesApps(t *testing.T) {
+	m := NewManager()
+
+	if joined, _ := m.AddMember("app-a", "presence-lobby", "a.1", &Member{UserID: "alice"}); !joined {
+		t.Fatal("alice did not join app-a")
+	}
+	if joined, _ := m.AddMember("app-a", "presence-lobby", "a.2", &Member{UserID: "bob"}); !joined {
+		t.Fatal("bob did not join app-a")
+	}
+	// the same user id in another app is a different user
+	if joined, _ := m.AddMember("app-b", "presence-lobby", "b.1", &Member{UserID: "alice", UserInfo: map[string]any{"app": "b"}}); !joined {
+		t.Fatal("alice joining app-b was treated as a second connection of app-a's alice")
+	}
+
+	ids := m.GetUserIDs("app-a", "presence-lobby")
+	slices.Sort(ids)
+	if !slices.Equal(ids, []string{"alice", "bob"}) {
+		t.Errorf("app-a users = %v, want [alice bob]", ids)
+	}
+	if ids := m.GetUserIDs("app-b", "presence-lobby"); !slices.Equal(ids, []string{"alice"}) {
+		t.Errorf("app-b users = %v, want [alice]", ids)
+	}
+
+	if count := m.GetUserCount("app-a", "presence-lobby"); count != 2 {
+		t.Errorf("app-a user count = %d, want 2", count)
+	}
+	if count := m.GetUserCount("app-b", "presence-lobby"); count != 1 {
+		t.Errorf("app-b user count = %d, want 1", count)
+	}
+
+	data := m.GetPresenceData("app-a", "presence-lobby")
+	if data.Count != 2 || data.Hash["alice"] != nil {
+		t.Errorf("app-a presence data = %+v, want 2 users without app-b's user info", data)
+	}
+	data = m.GetPresenceData("app-b", "presence-lobby")
+	if data.Count != 1 || data.Hash["alice"]["app"] != "b" {
+		t.Errorf("app-b presence data = %+v, want alice with app-b's user info", data)
+	}
+
+	if _, found := m.GetMember("app-b", "presence-lobby", "a.1"); found {
+		t.Error("app-a's connection is a member of app-b")
+	}
+}
+
+func TestManagerRemovesPerApp(t *testing.T) {
+	m := NewManager()
+	m.AddMember("app-a", "presence-lobby", "a.1", &Member{UserID: "alice"})
+	m.AddMember("app-b", "presence-lobby", "b.1", &Member{UserID: "alice"})
+
+	if member, _ := m.RemoveMember("app-a", "presence-lobby", "b.1"); member != nil {
+		t.Fatal("removed app-b's connection through app-a")
+	}
+
+	member, left := m.RemoveMember("app-a", "presence-lobby", "a.1")
+	if member == nil || !left {
+		t.Fatalf("RemoveMember = %v, %v, want alice to leave app-a", member, left)
+	}
+	if count := m.GetUserCount("app-a", "presence-lobby"); count != 0 {
+		t.Errorf("app-a user count = %d, want 0", count)
+	}
+	if count := m.GetUserCount("app-b", "presence-lobby"); count != 1 {
+		t.Errorf("app-b user count = %d after alice left app-a, want 1", count)
+	}
+}
+
+func TestChannelMembersCountsUsers(t *testing.T) {
+	c := NewChannelMembers()
+
+	if first := c.Add("1", &Member{UserID: "alice"}); !first {
+		t.Error("first connection of alice was not reported")
+	}
+	if first := c.Add("2", &Member{UserID: "alice"}); first {
+		t.Error("second connection of alice was reported as a new user")
+	}
+	if count, users := c.Count(), c.UserCount(); count != 2 || users != 1 {
+		t.Errorf("count = %d, users = %d, want 2 connections of 1 user", count, users)
+	}
+
+	if _, last := c.Remove("1"); last {
+		t.Error("alice left while a connection remains")
+	}
+	if _, last := c.Remove("2"); !last {
+		t.Error("alice did not leave with the last connection")
+	}
+}
@@ -0,0 +1,344 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aelpxy/pulse/liveness"
+	"github.com/charmbracelet/log"
+	"github.com/redis/go-redis/v9"
+)
+
+const storeTimeout = 5 * time.Second
+
+// addScript stores a member and increments its user's connection count,
+// returning the new count or 0 when the connection was already a member of that user
+//
+// KEYS: members, users, node entries
+// ARGV: member field, member json, user id, node entry
+var addScript = redis.NewScript(`
+local prev = redis.call('HGET', KEYS[1], ARGV[1])
+if prev then
+	local prevUser = cjson.decode(prev)['user_id']
+	if prevUser == ARGV[3] then
+		redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+		return 0
+	end
+	if redis.call('HINCRBY', KEYS[2], prevUser, -1) <= 0 then
+		redis.call('HDEL', KEYS[2], prevUser)
+	end
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('SADD', KEYS[3], ARGV[4])
+return redis.call('HINCRBY', KEYS[2], ARGV[3], 1)
+`)
+
+// removeScript deletes a member and decrements its user's connection count,
+// returning the member json and the remaining count
+//
+// KEYS: members, users, node entries
+// ARGV: member field, node entry
+var removeScript = redis.NewScript(`
+redis.call('SREM', KEYS[3], ARGV[2])
+local member = redis.call('HGET', KEYS[1], ARGV[1])
+if not member then
+	return false
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+local userID = cjson.decode(member)['user_id']
+local remaining = redis.call('HINCRBY', KEYS[2], userID, -1)
+if remaining <= 0 then
+	redis.call('HDEL', KEYS[2], userID)
+	remaining = 0
+end
+return {member, remaining}
+`)
+
+type localKey struct {
+	appID        string
+	channelName  string
+	connectionID string
+}
+
+// nodeEntry identifies a member owned by a node, so it can be removed when the node dies
+type nodeEntry struct {
+	AppID        string `json:"app_id"`
+	Channel      string `json:"channel"`
+	ConnectionID string `json:"connection_id"`
+}
+
+// RedisStore shares presence members between the nodes of a cluster. Every
+// channel has a hash of members keyed by node and connection and a hash of
+// connection counts per user, both updated atomically by lua scripts so that
+// user transitions are reported by exactly one node.
+//
+// Nodes send heartbeats to a sorted set. Members of a node that stops sending
+// them are removed by whichever node claims it first.
+type RedisStore struct {
+	client    *redis.Client
+	prefix    string
+	nodeID    string
+	local     map[localKey]*Member
+	localMux  sync.RWMutex
+	onReap    func(appID, channelName string, member *Member)
+	onRestore func(appID, channelName string, member *Member)
+	liveness  *liveness.Tracker
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// NewRedisStore starts the heartbeat of nodeID on a shared redis client,
+// keys are namespaced with prefix
+func NewRedisStore(client *redis.Client, prefix, nodeID string) *RedisStore {
+	if prefix == "" {
+		prefix = "pulse:"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &RedisStore{
+		client: client,
+		prefix: prefix,
+		nodeID: nodeID,
+		local:  make(map[localKey]*Member),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	s.liveness = liveness.Start("presence", liveness.NewRedis(client, s.nodesKey(), nodeID), liveness.Handlers{
+		Restore: s.restore,
+		Reap:    s.reapNodes,
+	})
+
+	return s
+}
+
+func (s *RedisStore) membersKey(appID, channelName string) string {
+	return s.prefix + "presence:" + appID + ":" + channelName + ":members"
+}
+
+func (s *RedisStore) usersKey(appID, channelName string) string {
+	return s.prefix + "presence:" + appID + ":" + channelName + ":users"
+}
+
+func (s *RedisStore) nodesKey() string {
+	return s.prefix + "presence:nodes"
+}
+
+func (s *RedisStore) nodeEntriesKey(nodeID string) string {
+	return s.prefix + "presence:node:" + nodeID
+}
+
+func memberField(nodeID, connectionID string) string {
+	return nodeID + "|" + connectionID
+}
+
+// SetReapHandler implements Reaper
+func (s *RedisStore) SetReapHandler(handler func(appID, channelName string, member *Member)) {
+	s.onReap = handler
+}
+
+// SetRestoreHandler implements Reaper
+func (s *RedisStore) SetRestoreHandler(handler func(appID, channelName string, member *Member)) {
+	s.onRestore = handler
+}
+
+func (s *RedisStore) AddMember(appID, channelName, connectionID string, member *Member) (bool, error) {
+	s.localMux.Lock()
+	s.local[localKey{appID, channelName, connectionID}] = member
+	s.localMux.Unlock()
+
+	ctx, cancel := context.WithTimeout(s.ctx, storeTimeout)
+	defer cancel()
+
+	count, err := s.add(ctx, appID, channelName, connectionID, member)
+	if err != nil {
+		return false, fmt.Errorf("failed to add presence member: %w", err)
+	}
+	return count == 1, nil
+}
+
+// add stores a member of this node and returns its user's connection count
+func (s *RedisStore) add(ctx context.Context, appID, channelName, connectionID string, member *Member) (int, error) {
+	data, err := json.Marshal(member)
+	if err != nil {
+		return 0, err
+	}
+	entry, _ := json.Marshal(nodeEntry{AppID: appID, Channel: channelName, ConnectionID: connectionID})
+
+	keys := []string{s.membersKey(appID, channelName), s.usersKey(appID, channelName), s.nodeEntriesKey(s.nodeID)}
+	return addScript.Run(ctx, s.client, keys, memberField(s.nodeID, connectionID), data, member.UserID, entry).Int()
+}
+
+func (s *RedisStore) RemoveMember(appID, channelName, connectionID string) (*Member, bool) {
+	s.localMux.Lock()
+	delete(s.local, localKey{appID, channelName, connectionID})
+	s.localMux.Unlock()
+
+	return s.remove(appID, channelName, s.nodeID, connectionID)
+}
+
+func (s *RedisStore) remove(appID, channelName, nodeID, connectionID string) (*Member, bool) {
+	entry, _ := json.Marshal(nodeEntry{AppID: appID, Channel: channelName, ConnectionID: connectionID})
+
+	ctx, cancel := context.WithTimeout(s.ctx, storeTimeout)
+	defer cancel()
+
+	keys := []string{s.membersKey(appID, channelName), s.usersKey(appID, channelName), s.nodeEntriesKey(nodeID)}
+	result, err := removeScript.Run(ctx, s.client, keys, memberField(nodeID, connectionID), entry).Slice()
+	if err != nil {
+		if err != redis.Nil {
+			log.Error("failed to remove presence member", "app", appID, "channel", channelName, "error", err)
+		}
+		return nil, false
+	}
+	if len(result) != 2 {
+		return nil, false
+	}
+
+	data, _ := result[0].(string)
+	remaining, _ := result[1].(int64)
+
+	member, err := ParseChannelData(data)
+	if err != nil {
+		log.Error("invalid presence member in redis", "app", appID, "channel", channelName, "error", err)
+		return nil, false
+	}
+	return member, remaining == 0
+}
+
+func (s *RedisStore) GetPresenceData(appID, channelName string) *PresenceData {
+	data := &PresenceData{
+		IDs:  []string{},
+		Hash: make(map[string]map[string]any),
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, storeTimeout)
+	defer cancel()
+
+	members, err := s.client.HVals(ctx, s.membersKey(appID, channelName)).Result()
+	if err != nil {
+		log.Error("failed to load presence members", "app", appID, "channel", channelName, "error", err)
+		return data
+	}
+
+	seenUsers := make(map[string]bool)
+	for _, raw := range members {
+		member, err := ParseChannelData(raw)
+		if err != nil {
+			continue
+		}
+		if !seenUsers[member.UserID] {
+			data.IDs = append(data.IDs, member.UserID)
+			seenUsers[member.UserID] = true
+		}
+		if member.UserInfo != nil {
+			data.Hash[member.UserID] = member.UserInfo
+		}
+	}
+	data.Count = len(data.IDs)
+	return data
+}
+
+func (s *RedisStore) GetUserCount(appID, channelName string) int {
+	ctx, cancel := context.WithTimeout(s.ctx, storeTimeout)
+	defer cancel()
+
+	count, err := s.client.HLen(ctx, s.usersKey(appID, channelName)).Result()
+	if err != nil {
+		log.Error("failed to count presence users", "app", appID, "channel", channelName, "error", err)
+		return 0
+	}
+	return int(count)
+}
+
+func (s *RedisStore) GetUserIDs(appID, channelName string) []string {
+	ctx, cancel := context.WithTimeout(s.ctx, storeTimeout)
+	defer cancel()
+
+	ids, err := s.client.HKeys(ctx, s.usersKey(appID, channelName)).Result()
+	if err != nil {
+		log.Error("failed to load presence users", "app", appID, "channel", channelName, "error", err)
+		return []string{}
+	}
+	return ids
+}
+
+// GetMember only returns members of connections on this node
+func (s *RedisStore) GetMember(appID, channelName, connectionID string) (*Member, bool) {
+	s.localMux.RLock()
+	defer s.localMux.RUnlock()
+	member, exists := s.local[localKey{appID, channelName, connectionID}]
+	return member, exists
+}
+
+// restore adds the members of this node's connections back and reports the
+// users that rejoined. The lock is held throughout so a member removed
+// meanwhile is not restored after its removal.
+func (s *RedisStore) restore(ctx context.Context) {
+	s.localMux.RLock()
+	defer s.localMux.RUnlock()
+
+	if len(s.local) == 0 {
+		return
+	}
+
+	log.Warn("presence heartbeat was missing, restoring members of this node", "node", s.nodeID, "members", len(s.local))
+	for key, member := range s.local {
+		count, err := s.add(ctx, key.appID, key.channelName, key.connectionID, member)
+		if err != nil {
+			log.Error("failed to restore presence member", "app", key.appID, "channel", key.channelName, "user", member.UserID, "error", err)
+			continue
+		}
+		if count == 1 && s.onRestore != nil {
+			s.onRestore(key.appID, key.channelName, member)
+		}
+	}
+}
+
+// reapNodes removes the members of dead nodes claimed by this one
+func (s *RedisStore) reapNodes(ctx context.Context, nodeIDs []string) {
+	for _, nodeID := range nodeIDs {
+		s.reapNode(ctx, nodeID)
+	}
+}
+
+func (s *RedisStore) reapNode(ctx context.Context, nodeID string) {
+	entries, err := s.client.SMembers(ctx, s.nodeEntriesKey(nodeID)).Result()
+	if err != nil {
+		log.Warn("failed to load members of dead node", "node", nodeID, "error", err)
+		return
+	}
+
+	removed := 0
+	for _, raw := range entries {
+		var entry nodeEntry
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+			continue
+		}
+
+		member, userLeft := s.remove(entry.AppID, entry.Channel, nodeID, entry.ConnectionID)
+		if member == nil {
+			continue
+		}
+		removed++
+
+		if userLeft && s.onReap != nil {
+			s.onReap(entry.AppID, entry.Channel, member)
+		}
+	}
+
+	s.client.Del(ctx, s.nodeEntriesKey(nodeID))
+	log.Info("removed presence members of dead node", "node", nodeID, "members", removed)
+}
+
+// Close stops the heartbeat and deregisters this node, its members are
+// expected to have been removed as its connections closed
+func (s *RedisStore) Close() error {
+	err := s.liveness.Stop()
+	s.cancel()
+	return err
+}
@@ -0,0 +1,158 @@
+package presence
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestClient(t *testing.T) *redis.Client {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func newTestStore(t *testing.T, client *redis.Client, nodeID string) *RedisStore {
+	t.Helper()
+
+	s := NewRedisStore(client, "pulse:", nodeID)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// expire makes the heartbeat of nodeID older than liveness.NodeTTL
+func expire(t *testing.T, client *redis.Client, nodeID string) {
+	t.Helper()
+
+	if err := client.ZAdd(t.Context(), "pulse:presence:nodes", redis.Z{Score: 0, Member: nodeID}).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisStoreSharesUsers(t *testing.T) {
+	client := newTestClient(t)
+	a := newTestStore(t, client, "node-a")
+	b := newTestStore(t, client, "node-b")
+
+	alice := &Member{UserID: "alice", UserInfo: map[string]any{"name": "Alice"}}
+	joinedA, errA := a.AddMember("app", "presence-lobby", "a.1", alice)
+	joinedB, errB := b.AddMember("app", "presence-lobby", "b.1", alice)
+	if errA != nil || errB != nil {
+		t.Fatalf("AddMember: %v, %v", errA, errB)
+	}
+	if joinedA == joinedB || !joinedA {
+		t.Fatalf("AddMember on node a = %v, node b = %v, want exactly one true for the first connection", joinedA, joinedB)
+	}
+
+	for _, s := range []*RedisStore{a, b} {
+		if ids := s.GetUserIDs("app", "presence-lobby"); !slices.Equal(ids, []string{"alice"}) {
+			t.Errorf("%s users = %v, want [alice]", s.nodeID, ids)
+		}
+		if data := s.GetPresenceData("app", "presence-lobby"); data.Count != 1 || data.Hash["alice"]["name"] != "Alice" {
+			t.Errorf("%s presence data = %+v, want alice once", s.nodeID, data)
+		}
+	}
+
+	member, left := a.RemoveMember("app", "presence-lobby", "a.1")
+	if member == nil || left {
+		t.Fatalf("RemoveMember on node a = %v, %v, want alice to stay connected on node b", member, left)
+	}
+	member, left = b.RemoveMember("app", "presence-lobby", "b.1")
+	if member == nil || !left || member.UserID != "alice" {
+		t.Fatalf("RemoveMember on node b = %v, %v, want alice to leave", member, left)
+	}
+	if count := a.GetUserCount("app", "presence-lobby"); count != 0 {
+		t.Errorf("user count = %d, want 0", count)
+	}
+}
+
+func TestRedisStoreReapsDeadNode(t *testing.T) {
+	client := newTestClient(t)
+	dead := newTestStore(t, client, "node-a")
+	live := newTestStore(t, client, "node-b")
+
+	type reaped struct {
+		appID, channelName string
+		member             *Member
+	}
+	var got []reaped
+	live.SetReapHandler(func(appID, channelName string, member *Member) {
+		got = append(got, reaped{appID, channelName, member})
+	})
+
+	dead.AddMember("app", "presence-lobby", "a.1", &Member{UserID: "alice"})
+	dead.AddMember("app", "presence-lobby", "a.2", &Member{UserID: "alice"})
+	dead.AddMember("app", "presence-lobby", "a.3", &Member{UserID: "bob"})
+	live.AddMember("app", "presence-lobby", "b.1", &Member{UserID: "bob"})
+
+	expire(t, client, "node-a")
+	live.liveness.Reap()
+
+	// bob is still connected to the live node, so only alice left
+	if len(got) != 1 || got[0].appID != "app" || got[0].channelName != "presence-lobby" || got[0].member.UserID != "alice" {
+		t.Fatalf("reap handler called with %+v, want alice leaving app presence-lobby once", got)
+	}
+	if ids := live.GetUserIDs("app", "presence-lobby"); !slices.Equal(ids, []string{"bob"}) {
+		t.Errorf("users = %v, want [bob]", ids)
+	}
+
+	// the node was claimed, reaping again must not report alice twice
+	live.liveness.Reap()
+	if len(got) != 1 {
+		t.Errorf("reap handler called %d times, want 1", len(got))
+	}
+}
+
+func TestRedisStoreRestoresReapedMembers(t *testing.T) {
+	client := newTestClient(t)
+	a := newTestStore(t, client, "node-a")
+	b := newTestStore(t, client, "node-b")
+
+	type restored struct {
+		appID, channelName, userID string
+	}
+	var got []restored
+	a.SetRestoreHandler(func(appID, channelName string, member *Member) {
+		got = append(got, restored{appID, channelName, member.UserID})
+	})
+
+	a.AddMember("app", "presence-lobby", "a.1", &Member{UserID: "alice"})
+
+	// node a was only slow, its heartbeat puts alice back
+	expire(t, client, "node-a")
+	b.liveness.Reap()
+	if count := b.GetUserCount("app", "presence-lobby"); count != 0 {
+		t.Fatalf("user count = %d after reaping, want 0", count)
+	}
+
+	a.liveness.Beat()
+	if ids := b.GetUserIDs("app", "presence-lobby"); !slices.Equal(ids, []string{"alice"}) {
+		t.Fatalf("users = %v after the heartbeat, want [alice]", ids)
+	}
+	// clients of other nodes saw alice leave, so she has to join again
+	if len(got) != 1 || got[0] != (restored{"app", "presence-lobby", "alice"}) {
+		t.Errorf("restore handler called with %+v, want alice rejoining app presence-lobby once", got)
+	}
+
+	if _, left := a.RemoveMember("app", "presence-lobby", "a.1"); !left {
+		t.Error("alice did not leave with the restored connection")
+	}
+}
+
+func TestRedisStoreReportsAddErrors(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+	s := newTestStore(t, client, "node-a")
+
+	// a failed write must not look like a second connection of the user
+	mr.Close()
+	if joined, err := s.AddMember("app", "presence-lobby", "a.1", &Member{UserID: "alice"}); err == nil {
+		t.Errorf("AddMember = %v, nil while redis is down, want an error", joined)
+	}
+}
@@ -1,5 +1,7 @@
 package protocol
 
+import "strings"
+
 const (
 	// system events
 	EventConnectionEstablished = "pusher:connection_established"
@@ -22,6 +24,9 @@ const (
 	PrivateChannelPrefix          = "private-"
 	PresenceChannelPrefix         = "presence-"
 	PrivateEncryptedChannelPrefix = "private-encrypted-"
+
+	// reserved channel pusher-js listens on for events sent to the signed in user
+	ServerToUserChannelPrefix = "#server-to-user-"
 )
 
 // socket close codes
@@ -95,6 +100,14 @@ func IsPresenceChannel(channel string) bool {
 		channel[:len(PresenceChannelPrefix)] == PresenceChannelPrefix
 }
 
+func IsServerToUserChannel(channel string) bool {
+	return strings.HasPrefix(channel, ServerToUserChannelPrefix)
+}
+
+func ServerToUserChannel(userID string) string {
+	return ServerToUserChannelPrefix + userID
+}
+
 func IsPublicChannel(channel string) bool {
 	return !IsPrivateChannel(channel) && !IsPresenceChannel(channel) && !IsEncryptedChannel(channel)
 }
@@ -77,6 +77,20 @@ type SubscribeData struct {
 	ChannelData *string `json:"channel_data,omitempty"`
 }
 
+type SigninData struct {
+	Auth     string `json:"auth"`
+	UserData string `json:"user_data"`
+}
+
+type SigninSuccessData struct {
+	UserData string `json:"user_data"`
+}
+
+// UserData is the part of the signin user_data the server relies on
+type UserData struct {
+	ID string `json:"id"`
+}
+
 type SubscriptionSucceededData struct {
 	Channel string `json:"channel,omitempty"`
 }
@@ -119,6 +133,10 @@ func NewPong() (*Message, error) {
 	return NewMessage("pusher:pong", nil, struct{}{})
 }
 
+func NewSigninSuccess(userData string) (*Message, error) {
+	return NewMessage(EventSigninSuccess, nil, SigninSuccessData{UserData: userData})
+}
+
 func NewSubscriptionSucceeded(channel string) (*Message, error) {
 	return NewMessage("pusher_internal:subscription_succeeded", &channel, struct{}{})
 }
@@ -146,3 +164,19 @@ func ParseSubscribeData(dataStr string) (*SubscribeData, error) {
 	}
 	return &data, nil
 }
+
+func ParseSigninData(dataStr string) (*SigninData, error) {
+	var data SigninData
+	if err := json.Unmarshal([]byte(dataStr), &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+func ParseUserData(dataStr string) (*UserData, error) {
+	var data UserData
+	if err := json.Unmarshal([]byte(dataStr), &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
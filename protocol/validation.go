@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// limits enforced by Pusher, see https://pusher.com/docs/channels/library_auth_reference/rest-api/#post-event-trigger-an-event
+const (
+	MaxChannelNameLength  = 200
+	MaxEventNameLength    = 200
+	MaxChannelsPerTrigger = 100
+	MaxEventDataSize      = 10240
+)
+
+var (
+	ErrEventDataTooLarge = errors.New("event data too large")
+
+	socketIDRegex    = regexp.MustCompile(`^\d+\.\d+$`)
+	channelNameRegex = regexp.MustCompile(`^[A-Za-z0-9_\-=@,.;]+$`)
+)
+
+// ValidateSocketID checks the socket id format publishers send for exclusion
+func ValidateSocketID(socketID string) error {
+	if !socketIDRegex.MatchString(socketID) {
+		return fmt.Errorf("invalid socket_id: %q", socketID)
+	}
+	return nil
+}
+
+// ValidateChannelName checks a channel name clients may subscribe to
+func ValidateChannelName(channel string) error {
+	if channel == "" {
+		return errors.New("channel name must not be empty")
+	}
+	if len(channel) > MaxChannelNameLength {
+		return fmt.Errorf("channel name exceeds %d characters", MaxChannelNameLength)
+	}
+	if !channelNameRegex.MatchString(channel) {
+		return fmt.Errorf("invalid channel name %q, allowed characters are [A-Za-z0-9_-=@,.;]", channel)
+	}
+	return nil
+}
+
+// ValidateTriggerChannel checks a channel name publishers may trigger on,
+// which also includes the reserved #server-to-user- channels
+func ValidateTriggerChannel(channel string) error {
+	if IsServerToUserChannel(channel) {
+		if len(channel) == len(ServerToUserChannelPrefix) {
+			return errors.New("missing user id in server-to-user channel")
+		}
+		if len(channel) > MaxChannelNameLength {
+			return fmt.Errorf("channel name exceeds %d characters", MaxChannelNameLength)
+		}
+		return nil
+	}
+	return ValidateChannelName(channel)
+}
+
+// ValidateTriggerChannels checks the channel list of a single trigger
+func ValidateTriggerChannels(channels []string) error {
+	if len(channels) == 0 {
+		return errors.New("no channels provided")
+	}
+	if len(channels) > MaxChannelsPerTrigger {
+		return fmt.Errorf("too many channels, a trigger may publish to at most %d", MaxChannelsPerTrigger)
+	}
+	for _, channel := range channels {
+		if err := ValidateTriggerChannel(channel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ValidateEventName(event string) error {
+	if event == "" {
+		return errors.New("event name must not be empty")
+	}
+	if len(event) > MaxEventNameLength {
+		return fmt.Errorf("event name exceeds %d characters", MaxEventNameLength)
+	}
+	return nil
+}
+
+// ValidateEventData returns an error wrapping ErrEventDataTooLarge when data exceeds MaxEventDataSize
+func ValidateEventData(data string) error {
+	if len(data) > MaxEventDataSize {
+		return fmt.Errorf("%w: %d bytes exceeds the %d byte limit", ErrEventDataTooLarge, len(data), MaxEventDataSize)
+	}
+	return nil
+}
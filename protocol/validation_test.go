@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateChannelName(t *testing.T) {
+	tests := []struct {
+		channel string
+		valid   bool
+	}{
+		{"lobby", true},
+		{"private-orders", true},
+		{"presence-room_1", true},
+		{"private-encrypted-a=b@c,d.e;f", true},
+		{strings.Repeat("a", MaxChannelNameLength), true},
+		{"", false},
+		{strings.Repeat("a", MaxChannelNameLength+1), false},
+		{"lobby room", false},
+		{"lobby/room", false},
+		{"#server-to-user-alice", false},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateChannelName(tt.channel); (err == nil) != tt.valid {
+			t.Errorf("ValidateChannelName(%q) = %v, want valid %v", tt.channel, err, tt.valid)
+		}
+	}
+}
+
+func TestValidateTriggerChannel(t *testing.T) {
+	tests := []struct {
+		channel string
+		valid   bool
+	}{
+		{"lobby", true},
+		{"#server-to-user-alice", true},
+		{"#server-to-user-", false},
+		{"#server-to-user-" + strings.Repeat("a", MaxChannelNameLength), false},
+		{"#lobby", false},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateTriggerChannel(tt.channel); (err == nil) != tt.valid {
+			t.Errorf("ValidateTriggerChannel(%q) = %v, want valid %v", tt.channel, err, tt.valid)
+		}
+	}
+}
+
+func TestValidateSocketID(t *testing.T) {
+	tests := []struct {
+		socketID string
+		valid    bool
+	}{
+		{"123.456", true},
+		{"", false},
+		{"123", false},
+		{"123.456.789", false},
+		{"abc.def", false},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateSocketID(tt.socketID); (err == nil) != tt.valid {
+			t.Errorf("ValidateSocketID(%q) = %v, want valid %v", tt.socketID, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aelpxy/pulse/apps"
+	"github.com/aelpxy/pulse/audit"
+	"github.com/aelpxy/pulse/metrics"
+	"github.com/charmbracelet/log"
+)
+
+const maxAdminBodySize = 64 * 1024
+
+// AdminHandler serves the admin API for managing apps at runtime, every
+// request must carry token as a bearer token
+func (s *Server) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/apps", s.handleAdminListApps)
+	mux.HandleFunc("POST /admin/apps", s.handleAdminCreateApp)
+	mux.HandleFunc("GET /admin/apps/{id}", s.handleAdminGetApp)
+	mux.HandleFunc("PATCH /admin/apps/{id}", s.handleAdminUpdateApp)
+	mux.HandleFunc("DELETE /admin/apps/{id}", s.handleAdminDeleteApp)
+	mux.HandleFunc("POST /admin/apps/{id}/enable", s.handleAdminSetEnabled(true))
+	mux.HandleFunc("POST /admin/apps/{id}/disable", s.handleAdminSetEnabled(false))
+	mux.HandleFunc("POST /admin/apps/{id}/rotate_secret", s.handleAdminRotateSecret)
+
+	expected := []byte("Bearer " + token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			log.Warn("admin request with invalid token", "path", r.URL.Path, "remote", r.RemoteAddr)
+			s.auditRequest(r, audit.Event{Type: audit.TypeAdminAuthFailed, Reason: "invalid admin token"})
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleAdminListApps(w http.ResponseWriter, r *http.Request) {
+	allApps, err := s.appsManager.ListApps()
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"apps":  allApps,
+		"count": len(allApps),
+	})
+}
+
+func (s *Server) handleAdminGetApp(w http.ResponseWriter, r *http.Request) {
+	app, err := s.appsManager.FindApp(r.PathValue("id"))
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, app)
+}
+
+func (s *Server) handleAdminCreateApp(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r, maxAdminBodySize)
+	if !ok {
+		return
+	}
+
+	// apps are enabled unless the request says otherwise
+	app := &apps.App{Enabled: true}
+	if err := json.Unmarshal(body, app); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if app.Key == "" {
+		app.Key = randomHex(10)
+	}
+	if app.Secret == "" {
+		app.Secret = randomHex(16)
+	}
+	if err := validateAdminApp(app); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.reloadMux.Lock()
+	defer s.reloadMux.Unlock()
+
+	if err := s.appsManager.CreateApp(app); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	log.Info("app created", "id", app.ID, "key", app.Key, "enabled", app.Enabled)
+	s.appsChanged(w, http.StatusCreated, app.ID, app)
+}
+
+func (s *Server) handleAdminUpdateApp(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r, maxAdminBodySize)
+	if !ok {
+		return
+	}
+
+	s.updateApp(w, r.PathValue("id"), func(app *apps.App) error {
+		if err := json.Unmarshal(body, app); err != nil {
+			return errors.New("invalid JSON")
+		}
+		return nil
+	})
+}
+
+func (s *Server) handleAdminSetEnabled(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.updateApp(w, r.PathValue("id"), func(app *apps.App) error {
+			app.Enabled = enabled
+			return nil
+		})
+	}
+}
+
+// handleAdminRotateSecret replaces the primary secret. With a grace_period
+// (in seconds) the old secret stays valid that long, so publishers and auth
+// endpoints can switch over without downtime.
+func (s *Server) handleAdminRotateSecret(w http.ResponseWriter, r *http.Request) {
+	var grace time.Duration
+	if value := r.URL.Query().Get("grace_period"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			http.Error(w, "Invalid grace_period", http.StatusBadRequest)
+			return
+		}
+		grace = time.Duration(seconds) * time.Second
+	}
+
+	s.updateApp(w, r.PathValue("id"), func(app *apps.App) error {
+		now := time.Now()
+		app.Secrets = slices.DeleteFunc(app.Secrets, func(secret apps.Secret) bool {
+			return secret.Expired(now)
+		})
+		if grace > 0 {
+			expiresAt := now.Add(grace).UTC().Truncate(time.Second)
+			app.Secrets = append(app.Secrets, apps.Secret{Secret: app.Secret, ExpiresAt: &expiresAt})
+		}
+		app.Secret = randomHex(16)
+		return nil
+	})
+}
+
+// updateApp applies change to a copy of an app and stores it. Connections of
+// an app that gets disabled or changes key are closed with a 4003 error.
+func (s *Server) updateApp(w http.ResponseWriter, id string, change func(app *apps.App) error) {
+	s.reloadMux.Lock()
+	defer s.reloadMux.Unlock()
+
+	previous, err := s.appsManager.FindApp(id)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	app := previous.Clone()
+	if err := change(app); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the id addresses the app and can't be changed
+	app.ID = previous.ID
+	if err := validateAdminApp(app); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.appsManager.UpdateApp(app); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	if previous.Enabled && (!app.Enabled || app.Key != previous.Key) {
+		closed := s.connectionMgr.DisconnectApp(previous.ID)
+		log.Info("app disabled or rekeyed", "id", app.ID, "key", previous.Key, "disconnected", closed)
+	}
+
+	log.Info("app updated", "id", app.ID, "key", app.Key, "enabled", app.Enabled)
+	s.appsChanged(w, http.StatusOK, app.ID, app)
+}
+
+func (s *Server) handleAdminDeleteApp(w http.ResponseWriter, r *http.Request) {
+	s.reloadMux.Lock()
+	defer s.reloadMux.Unlock()
+
+	previous, err := s.appsManager.FindApp(r.PathValue("id"))
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	if err := s.appsManager.DeleteApp(previous.ID); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	closed := 0
+	if previous.Enabled {
+		closed = s.connectionMgr.DisconnectApp(previous.ID)
+	}
+
+	log.Info("app deleted", "id", previous.ID, "key", previous.Key, "disconnected", closed)
+	s.appsChanged(w, http.StatusNoContent, previous.ID, nil)
+}
+
+// appsChanged persists the apps when configured and writes the response. app
+// is the changed app with the given id, nil when it was deleted. Must be called
+// with s.reloadMux held.
+func (s *Server) appsChanged(w http.ResponseWriter, status int, id string, app *apps.App) {
+	metrics.AppsLoaded.Set(float64(s.appsManager.GetAppCount()))
+
+	if s.appsManager.IsFileStore() {
+		// kept until saved, so that reloading the file doesn't undo the change
+		if app != nil {
+			s.adminChanges[id] = app.Clone()
+		} else {
+			s.adminChanges[id] = nil
+		}
+
+		if s.appsManager.GetServerConfig().Admin.Persist {
+			if err := s.persistApps(); err != nil {
+				log.Error("failed to persist apps", "file", s.configFile, "error", err)
+				http.Error(w, fmt.Sprintf("Change applied but not saved to the config file: %v", err), http.StatusInternalServerError)
+				return
+			}
+			clear(s.adminChanges)
+		}
+	}
+
+	if app == nil {
+		w.WriteHeader(status)
+		return
+	}
+	writeJSON(w, status, app)
+}
+
+// reapplyAdminChanges applies the unsaved changes of the admin API again after
+// the apps were reloaded from the config file, must be called with s.reloadMux held
+func (s *Server) reapplyAdminChanges() {
+	for id, app := range s.adminChanges {
+		_, findErr := s.appsManager.FindApp(id)
+
+		var err error
+		switch {
+		case app == nil && findErr == nil:
+			err = s.appsManager.DeleteApp(id)
+		case app == nil:
+		case findErr == nil:
+			err = s.appsManager.UpdateApp(app.Clone())
+		default:
+			err = s.appsManager.CreateApp(app.Clone())
+		}
+		if err != nil {
+			log.Warn("failed to keep unsaved admin change over the reloaded config", "id", id, "error", err)
+		}
+	}
+}
+
+func (s *Server) persistApps() error {
+	allApps, err := s.appsManager.ListApps()
+	if err != nil {
+		return err
+	}
+	return apps.WriteApps(s.configFile, allApps)
+}
+
+func validateAdminApp(app *apps.App) error {
+	if app.ID == "" {
+		return errors.New("id is required")
+	}
+	if strings.Contains(app.ID, "/") || strings.Contains(app.Key, "/") {
+		return errors.New("id and key must not contain '/'")
+	}
+	keys := map[string]bool{app.Key: true}
+	for _, k := range app.Keys {
+		if k.Key == "" || k.Secret == "" {
+			return errors.New("keys need a key and a secret")
+		}
+		if strings.Contains(k.Key, "/") {
+			return errors.New("keys must not contain '/'")
+		}
+		if keys[k.Key] {
+			return fmt.Errorf("duplicate key %q", k.Key)
+		}
+		keys[k.Key] = true
+	}
+	switch app.SlowConsumerPolicy {
+	case "", apps.SlowConsumerDrop, apps.SlowConsumerDropOldest, apps.SlowConsumerDisconnect:
+	default:
+		return fmt.Errorf("invalid slow_consumer_policy %q", app.SlowConsumerPolicy)
+	}
+	return nil
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, apps.ErrAppNotFound):
+		http.Error(w, "App not found", http.StatusNotFound)
+	case errors.Is(err, apps.ErrAppExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, apps.ErrReadOnlyStore):
+		// the request is valid but this store's apps can't be changed here
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		log.Error("admin request failed", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aelpxy/pulse/apps"
+)
+
+// adminRequest sends a request to the admin API with the given token
+func adminRequest(handler http.Handler, token, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestAdminRejectsInvalidTokens(t *testing.T) {
+	s := newTestServer(t, apps.App{ID: "1", Key: "key", Secret: "secret", Enabled: true})
+	admin := s.AdminHandler("token")
+
+	for _, token := range []string{"", "wrong", "token-with-suffix"} {
+		if rec := adminRequest(admin, token, http.MethodGet, "/admin/apps", ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: status = %d, want %d", token, rec.Code, http.StatusUnauthorized)
+		}
+	}
+
+	rec := adminRequest(admin, "wrong", http.MethodDelete, "/admin/apps/1", "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("delete with wrong token: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if _, exists := s.appsManager.GetAppByID("1"); !exists {
+		t.Error("app deleted by a request with a wrong token")
+	}
+}
+
+func TestAdminErrors(t *testing.T) {
+	s := newTestServer(t,
+		apps.App{ID: "1", Key: "key", Secret: "secret", Enabled: true},
+		apps.App{ID: "2", Key: "other-key", Secret: "secret", Enabled: true},
+	)
+	admin := s.AdminHandler("token")
+
+	tests := []struct {
+		name, method, path, body string
+		status                   int
+	}{
+		{"create with a used id", http.MethodPost, "/admin/apps", `{"id":"1","key":"new-key"}`, http.StatusConflict},
+		{"create with a used key", http.MethodPost, "/admin/apps", `{"id":"3","key":"key"}`, http.StatusConflict},
+		{"update to a used key", http.MethodPatch, "/admin/apps/2", `{"key":"key"}`, http.StatusConflict},
+		{"get a missing app", http.MethodGet, "/admin/apps/missing", "", http.StatusNotFound},
+		{"update a missing app", http.MethodPatch, "/admin/apps/missing", `{"name":"x"}`, http.StatusNotFound},
+		{"disable a missing app", http.MethodPost, "/admin/apps/missing/disable", "", http.StatusNotFound},
+		{"delete a missing app", http.MethodDelete, "/admin/apps/missing", "", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		if rec := adminRequest(admin, "token", tt.method, tt.path, tt.body); rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, rec.Code, tt.status, rec.Body.String())
+		}
+	}
+
+	if app, _ := s.appsManager.GetAppByID("2"); app.Key != "other-key" {
+		t.Errorf("app 2 key = %q after a conflicting update, want other-key", app.Key)
+	}
+}
+
+func TestAdminRejectsChangesToReadOnlyStores(t *testing.T) {
+	s := newTestServer(t)
+	s.appsManager.SetStore(unavailableStore{})
+	admin := s.AdminHandler("token")
+
+	tests := []struct {
+		method, path, body string
+	}{
+		{http.MethodGet, "/admin/apps", ""},
+		{http.MethodPost, "/admin/apps", `{"id":"1"}`},
+		{http.MethodPatch, "/admin/apps/1", `{"name":"x"}`},
+		{http.MethodDelete, "/admin/apps/1", ""},
+	}
+
+	// the request can't succeed by retrying, so it is not reported as a server error
+	for _, tt := range tests {
+		if rec := adminRequest(admin, "token", tt.method, tt.path, tt.body); rec.Code != http.StatusForbidden {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.path, rec.Code, http.StatusForbidden)
+		}
+	}
+}
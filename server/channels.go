@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/aelpxy/pulse/protocol"
+	"github.com/charmbracelet/log"
+)
+
+// parseInfo splits the comma separated info query attribute
+func parseInfo(info string) map[string]bool {
+	attributes := make(map[string]bool)
+	for attr := range strings.SplitSeq(info, ",") {
+		if attr = strings.TrimSpace(attr); attr != "" {
+			attributes[attr] = true
+		}
+	}
+	return attributes
+}
+
+type channelInfo struct {
+	SubscriptionCount *int `json:"subscription_count,omitempty"`
+	UserCount         *int `json:"user_count,omitempty"`
+}
+
+// subscriptionCounts returns the subscription count of every occupied
+// channel of the app when any of infos asks for subscription_count, nil
+// otherwise. Counts are aggregated across the cluster, so a request fetches
+// them once rather than once per channel.
+func (s *Server) subscriptionCounts(ctx context.Context, appID string, infos ...map[string]bool) (map[string]int, error) {
+	for _, info := range infos {
+		if info["subscription_count"] {
+			return s.connectionMgr.GetChannels(ctx, appID)
+		}
+	}
+	return nil, nil
+}
+
+// getChannelInfo collects the requested info attributes of a channel from
+// the counts of subscriptionCounts, user_count is only reported for presence
+// channels
+func (s *Server) getChannelInfo(appID, channelName string, info map[string]bool, subscriptionCounts map[string]int) channelInfo {
+	var result channelInfo
+	if info["subscription_count"] {
+		count := subscriptionCounts[channelName]
+		result.SubscriptionCount = &count
+	}
+	if info["user_count"] && protocol.IsPresenceChannel(channelName) {
+		count := s.connectionMgr.GetPresenceStore().GetUserCount(appID, channelName)
+		result.UserCount = &count
+	}
+	return result
+}
+
+// HandleChannels serves GET /apps/{app_id}/channels
+func (s *Server) HandleChannels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	targetApp, ok := s.resolveApp(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.authenticateRequest(w, r, targetApp, nil) {
+		return
+	}
+
+	query := r.URL.Query()
+	prefix := query.Get("filter_by_prefix")
+	info := parseInfo(query.Get("info"))
+
+	// user_count is only available when listing presence channels
+	if info["user_count"] && !strings.HasPrefix(prefix, protocol.PresenceChannelPrefix) {
+		http.Error(w, "user_count may only be requested for presence channels (filter_by_prefix=presence-)", http.StatusBadRequest)
+		return
+	}
+
+	counts, err := s.connectionMgr.GetChannels(r.Context(), targetApp.ID)
+	if err != nil {
+		log.Warn("failed to count channels", "app", targetApp.ID, "error", err)
+		http.Error(w, "Channel counts unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	presenceStore := s.connectionMgr.GetPresenceStore()
+
+	channels := make(map[string]channelInfo)
+	for name, subscriptionCount := range counts {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		var result channelInfo
+		if info["subscription_count"] {
+			count := subscriptionCount
+			result.SubscriptionCount = &count
+		}
+		if info["user_count"] {
+			count := presenceStore.GetUserCount(targetApp.ID, name)
+			result.UserCount = &count
+		}
+		channels[name] = result
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"channels": channels,
+	})
+}
+
+// HandleChannel serves GET /apps/{app_id}/channels/{channel_name}
+func (s *Server) HandleChannel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	targetApp, ok := s.resolveApp(w, r)
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 4 || parts[3] == "" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	channelName := parts[3]
+
+	if !s.authenticateRequest(w, r, targetApp, nil) {
+		return
+	}
+
+	info := parseInfo(r.URL.Query().Get("info"))
+	if info["user_count"] && !protocol.IsPresenceChannel(channelName) {
+		http.Error(w, "user_count may only be requested for presence channels", http.StatusBadRequest)
+		return
+	}
+
+	subscriptionCount, err := s.connectionMgr.GetSubscriptionCount(r.Context(), targetApp.ID, channelName)
+	if err != nil {
+		log.Warn("failed to count channel subscriptions", "app", targetApp.ID, "channel", channelName, "error", err)
+		http.Error(w, "Channel counts unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	type ChannelResponse struct {
+		Occupied          bool `json:"occupied"`
+		SubscriptionCount *int `json:"subscription_count,omitempty"`
+		UserCount         *int `json:"user_count,omitempty"`
+	}
+
+	resp := ChannelResponse{
+		Occupied: subscriptionCount > 0,
+	}
+	if info["subscription_count"] {
+		resp.SubscriptionCount = &subscriptionCount
+	}
+	if info["user_count"] {
+		count := s.connectionMgr.GetPresenceStore().GetUserCount(targetApp.ID, channelName)
+		resp.UserCount = &count
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleChannelUsers serves GET /apps/{app_id}/channels/{channel_name}/users
+func (s *Server) HandleChannelUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	targetApp, ok := s.resolveApp(w, r)
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 5 || parts[3] == "" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	channelName := parts[3]
+
+	if !s.authenticateRequest(w, r, targetApp, nil) {
+		return
+	}
+
+	if !protocol.IsPresenceChannel(channelName) {
+		http.Error(w, "Users may only be requested for presence channels", http.StatusBadRequest)
+		return
+	}
+
+	type User struct {
+		ID string `json:"id"`
+	}
+
+	userIDs := s.connectionMgr.GetPresenceStore().GetUserIDs(targetApp.ID, channelName)
+	users := make([]User, 0, len(userIDs))
+	for _, id := range userIDs {
+		users = append(users, User{ID: id})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"users": users,
+	})
+}
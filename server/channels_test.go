@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aelpxy/pulse/adapter"
+	"github.com/aelpxy/pulse/apps"
+	"github.com/aelpxy/pulse/auth"
+	"github.com/aelpxy/pulse/protocol"
+)
+
+// subscribeApp connects a client of app and subscribes it to channelName,
+// as userID on presence channels
+func subscribeApp(t *testing.T, url string, app apps.App, channelName, userID string) {
+	t.Helper()
+
+	ws, socketID := dialApp(t, url, app.Key)
+
+	data := map[string]any{"channel": channelName}
+	if strings.HasPrefix(channelName, "private-") || strings.HasPrefix(channelName, "presence-") {
+		var channelData *string
+		if userID != "" {
+			encoded := fmt.Sprintf(`{"user_id":%q}`, userID)
+			channelData = &encoded
+			data["channel_data"] = encoded
+		}
+		data["auth"] = auth.NewService(app.Key, app.Secret).GenerateAuthString(socketID, channelName, channelData)
+	}
+	if err := ws.WriteJSON(map[string]any{"event": protocol.EventSubscribe, "data": data}); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		var msg protocol.Message
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatalf("subscribe to %s: %v", channelName, err)
+		}
+		if msg.Event == protocol.EventSubscriptionSucceeded {
+			return
+		}
+		if msg.Event == protocol.EventError {
+			t.Fatalf("subscribe to %s: %s", channelName, msg.Data)
+		}
+	}
+}
+
+// getJSON sends a signed GET request to handler and decodes the response
+// body, which is only decoded when the status is 200
+func getJSON(t *testing.T, handler http.HandlerFunc, app apps.App, path string) (int, any) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	handler(rec, signedRequest(app, http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK {
+		return rec.Code, nil
+	}
+
+	var body any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s: response %q: %v", path, rec.Body.String(), err)
+	}
+	return rec.Code, body
+}
+
+// newChannelsServer returns a server whose app has two users with three
+// connections in presence-room and one subscriber each in lobby and private-orders
+func newChannelsServer(t *testing.T) (*Server, apps.App) {
+	t.Helper()
+
+	app := apps.App{ID: "1", Key: "key", Secret: "secret", Enabled: true}
+	s := newTestServer(t, app)
+
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleWebSocket))
+	t.Cleanup(ts.Close)
+
+	subscribeApp(t, ts.URL, app, "presence-room", "alice")
+	subscribeApp(t, ts.URL, app, "presence-room", "alice")
+	subscribeApp(t, ts.URL, app, "presence-room", "bob")
+	subscribeApp(t, ts.URL, app, "lobby", "")
+	subscribeApp(t, ts.URL, app, "private-orders", "")
+	return s, app
+}
+
+func TestChannels(t *testing.T) {
+	s, app := newChannelsServer(t)
+
+	tests := []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/apps/1/channels", http.StatusOK, `{"channels":{"lobby":{},"presence-room":{},"private-orders":{}}}`},
+		{"/apps/1/channels?filter_by_prefix=private-", http.StatusOK, `{"channels":{"private-orders":{}}}`},
+		{"/apps/1/channels?filter_by_prefix=presence-&info=subscription_count", http.StatusOK, `{"channels":{"presence-room":{"subscription_count":3}}}`},
+		{"/apps/1/channels?filter_by_prefix=presence-&info=user_count,subscription_count", http.StatusOK, `{"channels":{"presence-room":{"subscription_count":3,"user_count":2}}}`},
+		{"/apps/1/channels?filter_by_prefix=missing-", http.StatusOK, `{"channels":{}}`},
+		{"/apps/1/channels?info=user_count", http.StatusBadRequest, ""},
+		{"/apps/1/channels?filter_by_prefix=private-&info=user_count", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		status, body := getJSON(t, s.HandleChannels, app, tt.path)
+		if status != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.path, status, tt.status)
+			continue
+		}
+		if tt.want == "" {
+			continue
+		}
+
+		var want any
+		json.Unmarshal([]byte(tt.want), &want)
+		if !reflect.DeepEqual(body, want) {
+			t.Errorf("%s: body = %v, want %s", tt.path, body, tt.want)
+		}
+	}
+}
+
+func TestChannel(t *testing.T) {
+	s, app := newChannelsServer(t)
+
+	tests := []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/apps/1/channels/lobby", http.StatusOK, `{"occupied":true}`},
+		{"/apps/1/channels/lobby?info=subscription_count", http.StatusOK, `{"occupied":true,"subscription_count":1}`},
+		{"/apps/1/channels/presence-room?info=user_count,subscription_count", http.StatusOK, `{"occupied":true,"subscription_count":3,"user_count":2}`},
+		{"/apps/1/channels/presence-empty?info=user_count", http.StatusOK, `{"occupied":false,"user_count":0}`},
+		{"/apps/1/channels/empty?info=subscription_count", http.StatusOK, `{"occupied":false,"subscription_count":0}`},
+		{"/apps/1/channels/lobby?info=user_count", http.StatusBadRequest, ""},
+		{"/apps/1/channels/private-orders?info=user_count,subscription_count", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		status, body := getJSON(t, s.HandleChannel, app, tt.path)
+		if status != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.path, status, tt.status)
+			continue
+		}
+		if tt.want == "" {
+			continue
+		}
+
+		var want any
+		json.Unmarshal([]byte(tt.want), &want)
+		if !reflect.DeepEqual(body, want) {
+			t.Errorf("%s: body = %v, want %s", tt.path, body, tt.want)
+		}
+	}
+}
+
+func TestChannelUsers(t *testing.T) {
+	s, app := newChannelsServer(t)
+
+	status, body := getJSON(t, s.HandleChannelUsers, app, "/apps/1/channels/presence-room/users")
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+
+	// alice has two connections but is listed once
+	var ids []string
+	for _, user := range body.(map[string]any)["users"].([]any) {
+		ids = append(ids, user.(map[string]any)["id"].(string))
+	}
+	slices.Sort(ids)
+	if !slices.Equal(ids, []string{"alice", "bob"}) {
+		t.Errorf("users = %v, want [alice bob]", ids)
+	}
+
+	if status, body := getJSON(t, s.HandleChannelUsers, app, "/apps/1/channels/presence-empty/users"); status != http.StatusOK || len(body.(map[string]any)["users"].([]any)) != 0 {
+		t.Errorf("empty channel: status %d, body %v, want no users", status, body)
+	}
+
+	for _, channelName := range []string{"lobby", "private-orders"} {
+		if status, _ := getJSON(t, s.HandleChannelUsers, app, "/apps/1/channels/"+channelName+"/users"); status != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", channelName, status, http.StatusBadRequest)
+		}
+	}
+}
+
+// partialAdapter is a cluster where some nodes never report their counts
+type partialAdapter struct {
+	*adapter.Memory
+}
+
+func (partialAdapter) Channels(ctx context.Context, appID string) (map[string]int, error) {
+	return map[string]int{"lobby": 1}, fmt.Errorf("%w: 1 of 2 nodes replied", adapter.ErrPartialCounts)
+}
+
+func (partialAdapter) SubscriptionCount(ctx context.Context, appID, channel string) (int, error) {
+	return 1, fmt.Errorf("%w: 1 of 2 nodes replied", adapter.ErrPartialCounts)
+}
+
+func TestChannelsFailWithPartialCounts(t *testing.T) {
+	app := apps.App{ID: "1", Key: "key", Secret: "secret", Enabled: true}
+	s := newTestServer(t, app)
+	if err := s.connectionMgr.SetAdapter(partialAdapter{adapter.NewMemory()}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/apps/1/channels", s.HandleChannels},
+		{"/apps/1/channels/lobby", s.HandleChannel},
+	}
+
+	// low counts would be taken for the real ones, the request must fail instead
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		tt.handler(rec, signedRequest(app, http.MethodGet, tt.path, nil))
+
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: status = %d, want %d", tt.path, rec.Code, http.StatusServiceUnavailable)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aelpxy/pulse/metrics"
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// InstrumentHTTP records the count and duration of HTTP requests. WebSocket
+// upgrades are passed through untouched, connections have metrics of their own.
+func InstrumentHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/app/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		endpoint := endpointLabel(r.URL.Path)
+		metrics.HTTPRequestsTotal.WithLabelValues(endpoint, r.Method, strconv.Itoa(status)).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(endpoint, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// endpointLabel maps a request path to its route, so ids and channel names
+// don't end up as label values
+func endpointLabel(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	switch parts[0] {
+	case "apps":
+		switch {
+		case len(parts) == 1:
+			return "/apps"
+		case len(parts) == 3 && (parts[2] == "events" || parts[2] == "batch_events" || parts[2] == "channels"):
+			return "/apps/{app_id}/" + parts[2]
+		case len(parts) == 4 && parts[2] == "channels":
+			return "/apps/{app_id}/channels/{channel}"
+		case len(parts) == 5 && parts[2] == "channels" && parts[4] == "users":
+			return "/apps/{app_id}/channels/{channel}/users"
+		case len(parts) == 5 && parts[2] == "users" && (parts[4] == "events" || parts[4] == "terminate_connections"):
+			return "/apps/{app_id}/users/{user_id}/" + parts[4]
+		}
+	case "admin":
+		switch {
+		case len(parts) == 2 && parts[1] == "apps":
+			return "/admin/apps"
+		case len(parts) == 3 && parts[1] == "apps":
+			return "/admin/apps/{id}"
+		case len(parts) == 4 && parts[1] == "apps":
+			switch parts[3] {
+			case "enable", "disable", "rotate_secret":
+				return "/admin/apps/{id}/" + parts[3]
+			}
+		}
+	case "stats", "metrics", "health":
+		if len(parts) == 1 {
+			return "/" + parts[0]
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aelpxy/pulse/apps"
+	"github.com/aelpxy/pulse/metrics"
+	"github.com/aelpxy/pulse/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// observations returns how many requests the duration histogram recorded for a route
+func observations(t *testing.T, endpoint, method string) uint64 {
+	t.Helper()
+	return sampleCount(t, metrics.HTTPRequestDuration, endpoint, method)
+}
+
+// sampleCount returns how many values a histogram recorded for the given labels
+func sampleCount(t *testing.T, histogram *prometheus.HistogramVec, labels ...string) uint64 {
+	t.Helper()
+
+	var m dto.Metric
+	if err := histogram.WithLabelValues(labels...).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestInstrumentHTTP(t *testing.T) {
+	handler := InstrumentHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/apps/1/events":
+			w.Write([]byte("{}"))
+		case "/apps/1/channels/presence-lobby/users":
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		case "/admin/apps/1":
+			// the first status written is the one recorded
+			w.WriteHeader(http.StatusNoContent)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	tests := []struct {
+		method, path     string
+		endpoint, status string
+	}{
+		{"POST", "/apps/1/events", "/apps/{app_id}/events", "200"},
+		{"GET", "/apps/1/channels/presence-lobby/users", "/apps/{app_id}/channels/{channel}/users", "401"},
+		{"DELETE", "/admin/apps/1", "/admin/apps/{id}", "204"},
+		{"GET", "/unknown/path", "other", "200"},
+	}
+
+	for _, tt := range tests {
+		requests := metrics.HTTPRequestsTotal.WithLabelValues(tt.endpoint, tt.method, tt.status)
+		before, beforeObserved := testutil.ToFloat64(requests), observations(t, tt.endpoint, tt.method)
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil))
+
+		if got := testutil.ToFloat64(requests) - before; got != 1 {
+			t.Errorf("%s %s: requests{endpoint=%q, status=%q} grew by %v, want 1", tt.method, tt.path, tt.endpoint, tt.status, got)
+		}
+		if got := observations(t, tt.endpoint, tt.method) - beforeObserved; got != 1 {
+			t.Errorf("%s %s: duration{endpoint=%q} observed %d requests, want 1", tt.method, tt.path, tt.endpoint, got)
+		}
+	}
+}
+
+func TestInstrumentHTTPSkipsWebSockets(t *testing.T) {
+	called := false
+	handler := InstrumentHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the upgrader needs the original writer to hijack the connection
+		if _, ok := w.(http.Hijacker); !ok {
+			t.Error("websocket request did not get the original response writer")
+		}
+		called = true
+	}))
+
+	before := testutil.CollectAndCount(metrics.HTTPRequestsTotal)
+	handler.ServeHTTP(hijackRecorder{httptest.NewRecorder()}, httptest.NewRequest("GET", "/app/key", nil))
+
+	if !called {
+		t.Fatal("websocket request was not passed on")
+	}
+	if after := testutil.CollectAndCount(metrics.HTTPRequestsTotal); after != before {
+		t.Errorf("websocket request added %d request series", after-before)
+	}
+	if got := testutil.ToFloat64(metrics.HTTPRequestsTotal.WithLabelValues("other", "GET", "101")); got != 0 {
+		t.Errorf("websocket request was counted %v times", got)
+	}
+}
+
+// hijackRecorder stands in for the writer of a real connection
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, http.ErrNotSupported
+}
+
+func TestEndpointLabel(t *testing.T) {
+	tests := map[string]string{
+		"/apps":                                     "/apps",
+		"/apps/1/events":                            "/apps/{app_id}/events",
+		"/apps/1/batch_events":                      "/apps/{app_id}/batch_events",
+		"/apps/1/channels":                          "/apps/{app_id}/channels",
+		"/apps/1/channels/private-orders.eu":        "/apps/{app_id}/channels/{channel}",
+		"/apps/1/channels/presence-lobby/users":     "/apps/{app_id}/channels/{channel}/users",
+		"/apps/1/users/alice/events":                "/apps/{app_id}/users/{user_id}/events",
+		"/apps/1/users/alice/terminate_connections": "/apps/{app_id}/users/{user_id}/terminate_connections",
+		"/admin/apps":                               "/admin/apps",
+		"/admin/apps/1":                             "/admin/apps/{id}",
+		"/admin/apps/1/enable":                      "/admin/apps/{id}/enable",
+		"/admin/apps/1/disable":                     "/admin/apps/{id}/disable",
+		"/admin/apps/1/rotate_secret":               "/admin/apps/{id}/rotate_secret",
+		"/stats":                                    "/stats",
+		"/metrics":                                  "/metrics",
+		"/health":                                   "/health",
+		"/":                                         "other",
+		"/apps/1":                                   "other",
+		"/apps/1/unknown":                           "other",
+		"/apps/1/users/alice":                       "other",
+		"/admin/apps/1/delete":                      "other",
+		"/health/deep":                              "other",
+		"/wp-login.php":                             "other",
+	}
+
+	for path, want := range tests {
+		if got := endpointLabel(path); got != want {
+			t.Errorf("endpointLabel(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestDeliveryMetrics(t *testing.T) {
+	app := apps.App{ID: "1", Key: "delivery-key", Secret: "secret", Enabled: true}
+	s := newTestServer(t, app)
+
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleWebSocket))
+	t.Cleanup(ts.Close)
+
+	ws, _ := dialApp(t, ts.URL, app.Key)
+	if err := ws.WriteJSON(map[string]any{"event": protocol.EventSubscribe, "data": map[string]any{"channel": "lobby"}}); err != nil {
+		t.Fatal(err)
+	}
+	var msg protocol.Message
+	if err := ws.ReadJSON(&msg); err != nil || msg.Event != protocol.EventSubscriptionSucceeded {
+		t.Fatalf("got %+v, %v, want subscription_succeeded", msg, err)
+	}
+
+	histograms := map[string]*prometheus.HistogramVec{
+		"latency":        metrics.MessageLatency,
+		"queue wait":     metrics.MessageQueueWait,
+		"write duration": metrics.MessageWriteDuration,
+	}
+	before := make(map[string]uint64, len(histograms))
+	for name, histogram := range histograms {
+		before[name] = sampleCount(t, histogram, app.Key, "public")
+	}
+
+	rec := httptest.NewRecorder()
+	s.HandleEvents(rec, signedRequest(app, http.MethodPost, "/apps/1/events", []byte(`{"name":"ping","channel":"lobby","data":"{}"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("trigger status = %d: %s", rec.Code, rec.Body.String())
+	}
+	if err := ws.ReadJSON(&msg); err != nil || msg.Event != "ping" {
+		t.Fatalf("got %+v, %v, want the triggered event", msg, err)
+	}
+
+	// the write is observed once it returned, which may be after the client read it
+	deadline := time.Now().Add(2 * time.Second)
+	for name, histogram := range histograms {
+		for sampleCount(t, histogram, app.Key, "public")-before[name] != 1 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := sampleCount(t, histogram, app.Key, "public") - before[name]; got != 1 {
+			t.Errorf("%s{channel_type=public} observed %d events, want 1", name, got)
+		}
+	}
+}
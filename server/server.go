@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,20 +12,37 @@ import (
 	"sync"
 	"time"
 
+	"github.com/aelpxy/pulse/adapter"
 	"github.com/aelpxy/pulse/apps"
-	"github.com/aelpxy/pulse/auth"
+	"github.com/aelpxy/pulse/audit"
 	"github.com/aelpxy/pulse/channel"
 	"github.com/aelpxy/pulse/connection"
+	"github.com/aelpxy/pulse/metrics"
+	"github.com/aelpxy/pulse/presence"
+	"github.com/aelpxy/pulse/protocol"
+	"github.com/aelpxy/pulse/tracing"
+	"github.com/aelpxy/pulse/webhook"
 	"github.com/charmbracelet/log"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
+// triggerEnvelopeSize leaves room for up to 100 channel names and the json
+// fields around the event data in a trigger body
+const triggerEnvelopeSize = 32 * 1024
+
 type Server struct {
 	appsManager    *apps.Manager
 	channelManager *channel.Manager
 	connectionMgr  *connection.Manager
-	authServices   map[string]*auth.Service
-	authMux        sync.RWMutex
+	webhooks       *webhook.Dispatcher
+	adapter        adapter.Adapter
+	presenceStore  presence.Store
+	audit          *audit.Logger
+	reloadMux      sync.Mutex
+	configFile     string
+	adminChanges   map[string]*apps.App // unsaved admin API changes by app id, nil for deleted apps
 	upgrader       websocket.Upgrader
 	appPathRegex   *regexp.Regexp
 }
@@ -45,20 +63,47 @@ func New(config Config) (*Server, *apps.ServerConfig, error) {
 		return nil, nil, fmt.Errorf("failed to load apps config: %w", err)
 	}
 
-	log.Info("loaded apps", "count", appsMgr.GetAppCount(), "file", config.AppsConfigFile)
+	if err := setAppStore(appsMgr, serverConfig.AppStore); err != nil {
+		return nil, nil, err
+	}
+
+	log.Info("loaded apps", "count", appsMgr.GetAppCount(), "store", serverConfig.AppStore.Driver, "file", config.AppsConfigFile)
 
 	channelMgr := channel.NewManager()
 
 	connMgr := connection.NewManager(channelMgr, nil, config.MaxConnections)
 
-	authServices := make(map[string]*auth.Service)
 	for _, app := range appsMgr.GetAllApps() {
-		authServices[app.Key] = auth.NewService(app.Key, app.Secret)
 		log.Info("app registered", "name", app.Name, "key", app.Key, "max_connections", app.MaxConnections)
 	}
 
-	connMgr.SetAuthServices(authServices)
+	webhooks := webhook.NewDispatcher(nil)
+
 	connMgr.SetAppsManager(appsMgr)
+	connMgr.SetWebhookDispatcher(webhooks)
+
+	clusterAdapter, err := newAdapter(serverConfig.Adapter)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := connMgr.SetAdapter(clusterAdapter); err != nil {
+		clusterAdapter.Close()
+		return nil, nil, fmt.Errorf("failed to start cluster adapter: %w", err)
+	}
+
+	presenceStore := newPresenceStore(clusterAdapter, serverConfig.Adapter)
+	connMgr.SetPresenceStore(presenceStore)
+
+	var auditLogger *audit.Logger
+	if serverConfig.Audit.Path != "" {
+		auditLogger, err = audit.Open(serverConfig.Audit.Path)
+		if err != nil {
+			clusterAdapter.Close()
+			return nil, nil, err
+		}
+		connMgr.SetAuditLogger(auditLogger)
+		log.Info("audit log enabled", "path", serverConfig.Audit.Path)
+	}
 
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  4096,
@@ -72,12 +117,89 @@ func New(config Config) (*Server, *apps.ServerConfig, error) {
 		appsManager:    appsMgr,
 		channelManager: channelMgr,
 		connectionMgr:  connMgr,
-		authServices:   authServices,
+		webhooks:       webhooks,
+		adapter:        clusterAdapter,
+		presenceStore:  presenceStore,
+		audit:          auditLogger,
 		upgrader:       upgrader,
+		configFile:     config.AppsConfigFile,
+		adminChanges:   make(map[string]*apps.App),
 		appPathRegex:   regexp.MustCompile(`^/app/([^/]+)$`),
 	}, serverConfig, nil
 }
 
+// setAppStore switches the apps manager to a database when configured,
+// otherwise apps keep being loaded from the config file
+func setAppStore(appsMgr *apps.Manager, config apps.StoreConfig) error {
+	switch config.Driver {
+	case "", "file":
+		return nil
+	default:
+		store, err := apps.NewSQLStore(apps.SQLOptions{
+			Driver:           config.Driver,
+			DSN:              config.DSN,
+			Table:            config.Table,
+			CacheTTL:         time.Duration(config.CacheTTL) * time.Second,
+			NegativeCacheTTL: time.Duration(config.NegativeCacheTTL) * time.Second,
+		})
+		if err != nil {
+			return err
+		}
+		appsMgr.SetStore(store)
+		return nil
+	}
+}
+
+func newAdapter(config apps.AdapterConfig) (adapter.Adapter, error) {
+	switch config.Driver {
+	case "", "memory":
+		return adapter.NewMemory(), nil
+	case "redis":
+		redisAdapter, err := adapter.NewRedis(adapter.RedisOptions{
+			Addr:     config.Redis.Addr,
+			Password: config.Redis.Password,
+			DB:       config.Redis.DB,
+			PoolSize: config.Redis.PoolSize,
+			Prefix:   config.Redis.Prefix,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return redisAdapter, nil
+	case "nats":
+		natsAdapter, err := adapter.NewNATS(adapter.NATSOptions{
+			URL:      config.NATS.URL,
+			Name:     "pulse",
+			Token:    config.NATS.Token,
+			User:     config.NATS.User,
+			Password: config.NATS.Password,
+			Prefix:   config.NATS.Prefix,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return natsAdapter, nil
+	default:
+		return nil, fmt.Errorf("unknown adapter driver: %s", config.Driver)
+	}
+}
+
+// newPresenceStore keeps presence members in redis or the nats key value
+// bucket when nodes are connected through them, so every node sees the
+// members of the whole cluster
+func newPresenceStore(clusterAdapter adapter.Adapter, config apps.AdapterConfig) presence.Store {
+	switch a := clusterAdapter.(type) {
+	case *adapter.Redis:
+		return presence.NewRedisStore(a.Client(), config.Redis.Prefix, a.NodeID())
+	case *adapter.NATS:
+		// the adapter already warned that presence is not shared without jetstream
+		if kv := a.KeyValue(); kv != nil {
+			return presence.NewNATSStore(kv, a.NodeID())
+		}
+	}
+	return presence.NewManager()
+}
+
 func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -93,16 +215,26 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	appKey := matches[1]
 
-	app, exists := s.appsManager.GetApp(appKey)
-	if !exists {
+	app, err := s.appsManager.LookupApp(appKey)
+	if errors.Is(err, apps.ErrAppDisabled) {
+		metrics.ConnectionsRejected.WithLabelValues(appKey, "app_disabled").Inc()
+		log.Warn("disabled app", "key", appKey)
+		s.auditRequest(r, audit.Event{Type: audit.TypeAppDisabled, AppKey: appKey, Reason: "app disabled"})
+		http.Error(w, "App disabled", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, apps.ErrAppNotFound) {
+		// unknown keys are not used as label values, they are unbounded
+		metrics.ConnectionsRejected.WithLabelValues("", "unknown_app").Inc()
 		log.Warn("unknown app key", "key", appKey)
+		s.auditRequest(r, audit.Event{Type: audit.TypeUnknownApp, AppKey: appKey, Reason: "unknown app key"})
 		http.Error(w, "Unknown app", http.StatusNotFound)
 		return
 	}
-
-	if !app.Enabled {
-		log.Warn("disabled app", "key", appKey)
-		http.Error(w, "App disabled", http.StatusForbidden)
+	if err != nil {
+		metrics.ConnectionsRejected.WithLabelValues("", "store_unavailable").Inc()
+		// the key may well exist, clients should retry rather than give up on it
+		http.Error(w, "App store unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
@@ -116,7 +248,9 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if !originAllowed && origin != "" {
+		metrics.ConnectionsRejected.WithLabelValues(appKey, "origin_not_allowed").Inc()
 		log.Warn("origin not allowed", "app", appKey, "origin", origin)
+		s.auditRequest(r, audit.Event{Type: audit.TypeOriginDenied, AppID: app.ID, AppKey: appKey, Reason: fmt.Sprintf("origin %q not allowed", origin)})
 		http.Error(w, "Origin not allowed", http.StatusForbidden)
 		return
 	}
@@ -133,6 +267,7 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		if errors.Is(err, connection.ErrMaxConnectionsReached) || errors.Is(err, connection.ErrAppMaxConnections) {
 			log.Warn("max connections reached", "app", appKey)
+			s.auditRequest(r, audit.Event{Type: audit.TypeOverCapacity, AppID: app.ID, AppKey: appKey, Reason: err.Error()})
 			ws.WriteMessage(1, []byte(`{"event":"pusher:error","data":{"message":"Over capacity","code":4100}}`))
 		} else {
 			log.Error("failed to register connection", "error", err)
@@ -164,48 +299,126 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}()
 }
 
-func (s *Server) HandleEvents(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
+// resolveApp looks up the app addressed by an /apps/{app_id}/... request path
+func (s *Server) resolveApp(w http.ResponseWriter, r *http.Request) (*apps.App, bool) {
 	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
 	if len(parts) < 3 {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
-		return
+		return nil, false
 	}
-	appID := parts[1]
 
-	targetApp, exists := s.appsManager.GetAppByID(appID)
+	targetApp, exists := s.appsManager.GetAppByID(parts[1])
 	if !exists {
 		http.Error(w, "App not found", http.StatusNotFound)
-		return
+		return nil, false
+	}
+
+	return targetApp, true
+}
+
+// authenticateRequest validates the signature of an HTTP API request and
+// writes the error response if it does not match. Read only keys may only
+// make GET requests.
+func (s *Server) authenticateRequest(w http.ResponseWriter, r *http.Request, targetApp *apps.App, body []byte) bool {
+	authKey := r.URL.Query().Get("auth_key")
+
+	_, span := tracing.StartChild(r.Context(), "pulse.auth",
+		attribute.String("pulse.app_id", targetApp.ID),
+		attribute.String("pulse.auth_key", authKey),
+	)
+	defer span.End()
+
+	authSvc := targetApp.AuthService(true)
+	if err := authSvc.ValidateHTTPRequest(r.Method, r.URL.Path, r.URL.Query(), body); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		log.Warn("authentication failed", "error", err, "app", targetApp.Key, "auth_key", authKey, "path", r.URL.Path)
+		s.auditRequest(r, audit.Event{Type: audit.TypeHTTPAuthFailed, AppID: targetApp.ID, AppKey: authKey, Reason: err.Error()})
+		http.Error(w, fmt.Sprintf("Authentication failed: %v", err), http.StatusUnauthorized)
+		return false
+	}
+
+	if key, found := targetApp.FindKey(authKey); found && key.ReadOnly && r.Method != http.MethodGet {
+		span.SetStatus(codes.Error, "read only key")
+		log.Warn("read only key used for write request", "app", targetApp.Key, "auth_key", authKey, "path", r.URL.Path)
+		s.auditRequest(r, audit.Event{Type: audit.TypeHTTPForbidden, AppID: targetApp.ID, AppKey: authKey, Reason: "key is read only"})
+		http.Error(w, "Forbidden: key is read only", http.StatusForbidden)
+		return false
 	}
 
-	// limit request body size (default 10KB, or app's max message size)
-	maxBodySize := max(targetApp.GetMaxMessageSize(), 10240)
-	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	return true
+}
+
+// auditRequest records a security relevant event of an HTTP request
+func (s *Server) auditRequest(r *http.Request, event audit.Event) {
+	event.RemoteIP = audit.RemoteIP(r.RemoteAddr)
+	event.Path = r.URL.Path
+	s.audit.Log(event)
+}
+
+// readBody reads a request body of at most limit bytes, answering 413 when it is larger
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	defer r.Body.Close()
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("Request body exceeds %d bytes", limit), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		}
+		return nil, false
+	}
+	return body, true
+}
+
+// validateEvent checks the event name and data of a trigger and returns the
+// http status to answer with when they are rejected
+func validateEvent(name, data string) (int, error) {
+	if err := protocol.ValidateEventName(name); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := protocol.ValidateEventData(data); err != nil {
+		return http.StatusRequestEntityTooLarge, err
+	}
+	return http.StatusOK, nil
+}
+
+// publish routes a triggered event to a channel or, for #server-to-user-
+// channels, to the connections of the signed in user. received is when the
+// request arrived, for latency metrics.
+func (s *Server) publish(ctx context.Context, appID, channelName, event, data, excludeSocketID string, received time.Time) {
+	if protocol.IsServerToUserChannel(channelName) {
+		userID := strings.TrimPrefix(channelName, protocol.ServerToUserChannelPrefix)
+		s.connectionMgr.SendToUser(ctx, appID, userID, event, data, received)
 		return
 	}
-	defer r.Body.Close()
+	s.connectionMgr.PublishToChannel(ctx, appID, channelName, event, data, excludeSocketID, received)
+}
 
-	s.authMux.RLock()
-	authSvc, exists := s.authServices[targetApp.Key]
-	s.authMux.RUnlock()
+func (s *Server) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
 
-	if !exists {
-		http.Error(w, "Authentication service not found", http.StatusInternalServerError)
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	if err := authSvc.ValidateHTTPRequest(r.Method, r.URL.Path, r.URL.Query(), body); err != nil {
-		log.Warn("authentication failed", "error", err, "app", targetApp.Key, "path", r.URL.Path)
-		http.Error(w, fmt.Sprintf("Authentication failed: %v", err), http.StatusUnauthorized)
+	targetApp, ok := s.resolveApp(w, r)
+	if !ok {
+		return
+	}
+
+	// limit request body size to the event data limit plus room for the
+	// channel list and json envelope
+	maxBodySize := max(targetApp.GetMaxMessageSize(), protocol.MaxEventDataSize) + triggerEnvelopeSize
+	body, ok := readBody(w, r, maxBodySize)
+	if !ok {
+		return
+	}
+
+	if !s.authenticateRequest(w, r, targetApp, body) {
 		return
 	}
 
@@ -214,48 +427,84 @@ func (s *Server) HandleEvents(w http.ResponseWriter, r *http.Request) {
 		Channel  string   `json:"channel"`
 		Channels []string `json:"channels"`
 		Data     string   `json:"data"`
+		SocketID string   `json:"socket_id,omitempty"`
+		Info     string   `json:"info,omitempty"`
 	}
 
 	var trigger TriggerRequest
-	if err := json.Unmarshal(body, &trigger); err != nil {
+	if err := decodeJSON(r.Context(), body, &trigger); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
+	if trigger.SocketID != "" {
+		if err := protocol.ValidateSocketID(trigger.SocketID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	channels := trigger.Channels
 	if trigger.Channel != "" {
 		channels = append(channels, trigger.Channel)
 	}
 
+	if err := protocol.ValidateTriggerChannels(channels); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if status, err := validateEvent(trigger.Name, trigger.Data); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	ctx, span := tracing.StartChild(r.Context(), "pulse.publish",
+		attribute.String("pulse.app_id", targetApp.ID),
+		attribute.String("pulse.event", trigger.Name),
+		attribute.Int("pulse.channels", len(channels)),
+	)
 	for _, ch := range channels {
-		var data any
-		if err := json.Unmarshal([]byte(trigger.Data), &data); err != nil {
-			log.Warn("failed to parse event data", "error", err, "channel", ch)
-			continue
-		}
-		s.connectionMgr.PublishToChannel(ch, trigger.Name, data)
+		s.publish(ctx, targetApp.ID, ch, trigger.Name, trigger.Data, trigger.SocketID, received)
 	}
+	span.End()
 
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{}`)
+
+	if trigger.Info == "" {
+		fmt.Fprintf(w, `{}`)
+		return
+	}
+
+	info := parseInfo(trigger.Info)
+	// the events were published already, failing the request would have them
+	// published again by a retry, so low counts are reported instead
+	counts, err := s.subscriptionCounts(r.Context(), targetApp.ID, info)
+	if err != nil {
+		log.Warn("failed to count channel subscriptions", "app", targetApp.ID, "error", err)
+	}
+	channelsInfo := make(map[string]channelInfo, len(channels))
+	for _, ch := range channels {
+		if !protocol.IsServerToUserChannel(ch) {
+			channelsInfo[ch] = s.getChannelInfo(targetApp.ID, ch, info, counts)
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"channels": channelsInfo,
+	})
 }
 
 func (s *Server) HandleBatchEvents(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
+
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
-	if len(parts) < 3 {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
-		return
-	}
-	appID := parts[1]
-
-	targetApp, exists := s.appsManager.GetAppByID(appID)
-	if !exists {
-		http.Error(w, "App not found", http.StatusNotFound)
+	targetApp, ok := s.resolveApp(w, r)
+	if !ok {
 		return
 	}
 
@@ -263,35 +512,21 @@ func (s *Server) HandleBatchEvents(w http.ResponseWriter, r *http.Request) {
 	// min 100KB for batch
 	maxBodySize := max(targetApp.GetMaxMessageSize()*10,
 		102400)
-	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
-
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+	body, ok := readBody(w, r, maxBodySize)
+	if !ok {
 		return
 	}
-	defer r.Body.Close()
 
-	s.authMux.RLock()
-	authSvc, exists := s.authServices[targetApp.Key]
-	s.authMux.RUnlock()
-
-	if !exists {
-		http.Error(w, "Authentication service not found", http.StatusInternalServerError)
-		return
-	}
-
-	if err := authSvc.ValidateHTTPRequest(r.Method, r.URL.Path, r.URL.Query(), body); err != nil {
-		log.Warn("authentication failed", "error", err, "app", targetApp.Key, "path", r.URL.Path)
-		http.Error(w, fmt.Sprintf("Authentication failed: %v", err), http.StatusUnauthorized)
+	if !s.authenticateRequest(w, r, targetApp, body) {
 		return
 	}
 
 	type BatchEvent struct {
-		Name    string `json:"name"`
-		Channel string `json:"channel"`
-		Data    string `json:"data"`
-		Info    string `json:"info,omitempty"`
+		Name     string `json:"name"`
+		Channel  string `json:"channel"`
+		Data     string `json:"data"`
+		SocketID string `json:"socket_id,omitempty"`
+		Info     string `json:"info,omitempty"`
 	}
 
 	type BatchRequest struct {
@@ -299,7 +534,7 @@ func (s *Server) HandleBatchEvents(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var batchReq BatchRequest
-	if err := json.Unmarshal(body, &batchReq); err != nil {
+	if err := decodeJSON(r.Context(), body, &batchReq); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
@@ -310,36 +545,47 @@ func (s *Server) HandleBatchEvents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	type EventResponse struct {
-		SubscriptionCount *int `json:"subscription_count,omitempty"`
-		UserCount         *int `json:"user_count,omitempty"`
+	for i, event := range batchReq.Batch {
+		if err := protocol.ValidateTriggerChannel(event.Channel); err != nil {
+			http.Error(w, fmt.Sprintf("batch[%d]: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		if status, err := validateEvent(event.Name, event.Data); err != nil {
+			http.Error(w, fmt.Sprintf("batch[%d]: %v", i, err), status)
+			return
+		}
+		if event.SocketID == "" {
+			continue
+		}
+		if err := protocol.ValidateSocketID(event.SocketID); err != nil {
+			http.Error(w, fmt.Sprintf("batch[%d]: %v", i, err), http.StatusBadRequest)
+			return
+		}
 	}
 
-	responses := make([]EventResponse, len(batchReq.Batch))
+	ctx, span := tracing.StartChild(r.Context(), "pulse.publish",
+		attribute.String("pulse.app_id", targetApp.ID),
+		attribute.Int("pulse.events", len(batchReq.Batch)),
+	)
+	for _, event := range batchReq.Batch {
+		s.publish(ctx, targetApp.ID, event.Channel, event.Name, event.Data, event.SocketID, received)
+	}
+	span.End()
 
+	infos := make([]map[string]bool, len(batchReq.Batch))
 	for i, event := range batchReq.Batch {
-		var data any
-		if err := json.Unmarshal([]byte(event.Data), &data); err != nil {
-			log.Warn("failed to parse event data", "error", err, "channel", event.Channel, "event", event.Name)
-		}
+		infos[i] = parseInfo(event.Info)
+	}
+	// the events were published already, failing the request would have them
+	// published again by a retry, so low counts are reported instead
+	counts, err := s.subscriptionCounts(r.Context(), targetApp.ID, infos...)
+	if err != nil {
+		log.Warn("failed to count channel subscriptions", "app", targetApp.ID, "error", err)
+	}
 
-		s.connectionMgr.PublishToChannel(event.Channel, event.Name, data)
-
-		var resp EventResponse
-		if event.Info != "" {
-			infoParts := strings.Split(event.Info, ",")
-			for _, info := range infoParts {
-				info = strings.TrimSpace(info)
-				if info == "subscription_count" {
-					count := len(s.channelManager.GetSubscribers(event.Channel))
-					resp.SubscriptionCount = &count
-				} else if info == "user_count" && strings.HasPrefix(event.Channel, "presence-") {
-					count := len(s.channelManager.GetSubscribers(event.Channel))
-					resp.UserCount = &count
-				}
-			}
-		}
-		responses[i] = resp
+	responses := make([]channelInfo, len(batchReq.Batch))
+	for i, event := range batchReq.Batch {
+		responses[i] = s.getChannelInfo(targetApp.ID, event.Channel, infos[i], counts)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -380,38 +626,66 @@ func (s *Server) HandleApps(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) Shutdown(timeout time.Duration) error {
-	return s.connectionMgr.Shutdown(timeout)
+	err := s.connectionMgr.Shutdown(timeout)
+
+	// flush webhooks produced by the connections closing above
+	if whErr := s.webhooks.Shutdown(timeout); whErr != nil && err == nil {
+		err = whErr
+	}
+
+	// the presence store shares the adapter's redis client, close it first
+	if closer, ok := s.presenceStore.(io.Closer); ok {
+		if presenceErr := closer.Close(); presenceErr != nil && err == nil {
+			err = presenceErr
+		}
+	}
+
+	if adapterErr := s.adapter.Close(); adapterErr != nil && err == nil {
+		err = adapterErr
+	}
+
+	if storeErr := s.appsManager.Close(); storeErr != nil && err == nil {
+		err = storeErr
+	}
+
+	if auditErr := s.audit.Close(); auditErr != nil && err == nil {
+		err = auditErr
+	}
+
+	return err
 }
 
 func (s *Server) GetAppsManager() *apps.Manager {
 	return s.appsManager
 }
 
+// ReloadApps reloads the apps from configFile. New connections get the new
+// limits, connections of apps that were removed, disabled or rekeyed are
+// closed with 4003. Changes made through the admin API that were not saved to
+// the file are kept.
 func (s *Server) ReloadApps(configFile string) error {
-	newAppsMgr := apps.NewManager()
-	_, err := newAppsMgr.LoadFromFile(configFile)
-	if err != nil {
+	s.reloadMux.Lock()
+	defer s.reloadMux.Unlock()
+
+	previous := s.appsManager.GetAllApps()
+
+	// the apps manager is shared with the connection manager, so load into it
+	// in place rather than swapping it
+	if _, err := s.appsManager.LoadFromFile(configFile); err != nil {
 		return fmt.Errorf("failed to reload apps: %w", err)
 	}
+	s.reapplyAdminChanges()
 
-	// Update auth services
-	s.authMux.Lock()
-	s.authServices = make(map[string]*auth.Service)
-	for _, app := range newAppsMgr.GetAllApps() {
-		s.authServices[app.Key] = auth.NewService(app.Key, app.Secret)
-	}
-	authServicesCopy := make(map[string]*auth.Service)
-	for k, v := range s.authServices {
-		authServicesCopy[k] = v
+	// disabled apps are not loaded, so they are treated like removed ones
+	for _, app := range previous {
+		if current, exists := s.appsManager.GetAppByID(app.ID); !exists || current.Key != app.Key {
+			closed := s.connectionMgr.DisconnectApp(app.ID)
+			log.Info("app removed, disabled or rekeyed", "id", app.ID, "name", app.Name, "key", app.Key, "disconnected", closed)
+		}
 	}
-	s.authMux.Unlock()
-
-	// Update connection manager's auth services
-	s.connectionMgr.SetAuthServices(authServicesCopy)
 
-	// Update apps manager (thread-safe as it's only read after startup)
-	s.appsManager = newAppsMgr
+	metrics.AppsLoaded.Set(float64(s.appsManager.GetAppCount()))
 
-	log.Info("reloaded apps", "count", newAppsMgr.GetAppCount())
+	log.Info("reloaded apps", "count", s.appsManager.GetAppCount())
 	return nil
 }
@@ -0,0 +1,393 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aelpxy/pulse/apps"
+	"github.com/aelpxy/pulse/audit"
+	"github.com/aelpxy/pulse/metrics"
+	"github.com/aelpxy/pulse/protocol"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestServer returns a server loading appList from a temporary config file
+func newTestServer(t *testing.T, appList ...apps.App) *Server {
+	t.Helper()
+
+	data, err := json.Marshal(apps.Config{Apps: appList})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configFile, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, _, err := New(Config{AppsConfigFile: configFile, MaxConnections: 100})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { s.Shutdown(5 * time.Second) })
+	return s
+}
+
+// writeApps replaces the apps of the server's config file
+func writeApps(t *testing.T, s *Server, appList ...apps.App) {
+	t.Helper()
+
+	data, err := json.Marshal(apps.Config{Apps: appList})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.configFile, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dialApp opens a websocket connection to the app with the given key, waits
+// for connection_established and returns the connection and its socket id
+func dialApp(t *testing.T, url, key string) (*websocket.Conn, string) {
+	t.Helper()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/app/"+key, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", key, err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	var msg protocol.Message
+	if err := ws.ReadJSON(&msg); err != nil || msg.Event != protocol.EventConnectionEstablished {
+		t.Fatalf("%s: first message %+v, %v, want connection_established", key, msg, err)
+	}
+	var established protocol.ConnectionEstablishedData
+	if err := json.Unmarshal([]byte(msg.Data), &established); err != nil {
+		t.Fatalf("%s: connection_established data %q: %v", key, msg.Data, err)
+	}
+	return ws, established.SocketID
+}
+
+// closeCode reads until the connection is closed and returns the close code,
+// or 0 when it is still open after a second
+func closeCode(ws *websocket.Conn) int {
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				return closeErr.Code
+			}
+			return 0
+		}
+	}
+}
+
+// signedRequest builds an HTTP API request signed with the app's key and
+// secret, path may carry query parameters
+func signedRequest(app apps.App, method, path string, body []byte) *http.Request {
+	path, rawQuery, _ := strings.Cut(path, "?")
+	query, _ := url.ParseQuery(rawQuery)
+	query.Set("auth_key", app.Key)
+	query.Set("auth_timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	query.Set("auth_version", "1.0")
+	if len(body) > 0 {
+		sum := md5.Sum(body)
+		query.Set("body_md5", hex.EncodeToString(sum[:]))
+	}
+	query.Set("auth_signature", app.AuthService(true).GenerateHTTPSignature(method, path, query))
+
+	return httptest.NewRequest(method, path+"?"+query.Encode(), bytes.NewReader(body))
+}
+
+func TestWebSocketRejectsDisabledApps(t *testing.T) {
+	enabled := apps.App{ID: "1", Key: "key", Secret: "secret", Enabled: true}
+	disabled := apps.App{ID: "2", Key: "disabled-key", Secret: "secret"}
+	s := newTestServer(t, enabled, disabled)
+
+	var auditLog bytes.Buffer
+	s.audit = audit.New(&auditLog)
+
+	tests := []struct {
+		key, reason string
+		status      int
+		event       string
+	}{
+		{"disabled-key", "app_disabled", http.StatusForbidden, audit.TypeAppDisabled},
+		{"missing-key", "unknown_app", http.StatusNotFound, audit.TypeUnknownApp},
+	}
+
+	for _, tt := range tests {
+		label := tt.key
+		if tt.reason == "unknown_app" {
+			label = ""
+		}
+		rejected := metrics.ConnectionsRejected.WithLabelValues(label, tt.reason)
+		before := testutil.ToFloat64(rejected)
+		auditLog.Reset()
+
+		rec := httptest.NewRecorder()
+		s.HandleWebSocket(rec, httptest.NewRequest(http.MethodGet, "/app/"+tt.key, nil))
+
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.key, rec.Code, tt.status)
+		}
+		if got := testutil.ToFloat64(rejected) - before; got != 1 {
+			t.Errorf("%s: rejections with reason %s grew by %v, want 1", tt.key, tt.reason, got)
+		}
+
+		var event audit.Event
+		if err := json.Unmarshal(auditLog.Bytes(), &event); err != nil || event.Type != tt.event || event.AppKey != tt.key {
+			t.Errorf("%s: audit event = %s, want %s", tt.key, auditLog.String(), tt.event)
+		}
+	}
+}
+
+// unavailableStore fails every lookup like a database that can't be reached
+type unavailableStore struct{}
+
+var errUnavailable = errors.New("connection refused")
+
+func (unavailableStore) GetApp(ctx context.Context, key string) (*apps.App, error) {
+	return nil, errUnavailable
+}
+
+func (unavailableStore) GetAppByID(ctx context.Context, id string) (*apps.App, error) {
+	return nil, errUnavailable
+}
+
+func (unavailableStore) GetAllApps(ctx context.Context) ([]*apps.App, error) {
+	return nil, errUnavailable
+}
+
+func (unavailableStore) Close() error { return nil }
+
+func TestWebSocketRejectsWhileStoreIsDown(t *testing.T) {
+	s := newTestServer(t)
+	s.appsManager.SetStore(unavailableStore{})
+
+	var auditLog bytes.Buffer
+	s.audit = audit.New(&auditLog)
+
+	rejected := metrics.ConnectionsRejected.WithLabelValues("", "store_unavailable")
+	before := testutil.ToFloat64(rejected)
+
+	rec := httptest.NewRecorder()
+	s.HandleWebSocket(rec, httptest.NewRequest(http.MethodGet, "/app/key", nil))
+
+	// an outage must not tell clients that their key does not exist
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if got := testutil.ToFloat64(rejected) - before; got != 1 {
+		t.Errorf("rejections with reason store_unavailable grew by %v, want 1", got)
+	}
+	if auditLog.Len() != 0 {
+		t.Errorf("audit log = %s, want no unknown app event for an outage", auditLog.String())
+	}
+}
+
+func TestHTTPAuthAcceptsActiveSecrets(t *testing.T) {
+	now := time.Now()
+	later, earlier := now.Add(time.Hour), now.Add(-time.Second)
+	app := apps.App{ID: "1", Key: "key", Secret: "new-secret", Enabled: true, Secrets: []apps.Secret{
+		{Secret: "rotated-secret", ExpiresAt: &later},
+		{Secret: "expired-secret", ExpiresAt: &earlier},
+		{Secret: "permanent-secret"},
+	}}
+	s := newTestServer(t, app)
+
+	tests := []struct {
+		secret string
+		status int
+	}{
+		{"new-secret", http.StatusOK},
+		{"rotated-secret", http.StatusOK},
+		{"permanent-secret", http.StatusOK},
+		{"expired-secret", http.StatusUnauthorized},
+		{"unknown-secret", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		// signs with tt.secret as if it was the primary
+		signer := apps.App{Key: app.Key, Secret: tt.secret}
+
+		rec := httptest.NewRecorder()
+		s.HandleChannels(rec, signedRequest(signer, http.MethodGet, "/apps/1/channels", nil))
+
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.secret, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestHTTPAuthScopesAdditionalKeys(t *testing.T) {
+	disabled := false
+	app := apps.App{ID: "1", Key: "key", Secret: "secret", Enabled: true, Keys: []apps.AppKey{
+		{Key: "backend-key", Secret: "backend-secret"},
+		{Key: "reader-key", Secret: "reader-secret", ReadOnly: true},
+		{Key: "revoked-key", Secret: "revoked-secret", Enabled: &disabled},
+	}}
+	other := apps.App{ID: "2", Key: "other-key", Secret: "other-secret", Enabled: true}
+	s := newTestServer(t, app, other)
+
+	backend := apps.App{Key: "backend-key", Secret: "backend-secret"}
+	reader := apps.App{Key: "reader-key", Secret: "reader-secret"}
+	revoked := apps.App{Key: "revoked-key", Secret: "revoked-secret"}
+
+	event := []byte(`{"name":"ping","channel":"lobby","data":"{}"}`)
+	batch := []byte(`{"batch":[{"name":"ping","channel":"lobby","data":"{}"}]}`)
+	userEvent := []byte(`{"name":"ping","data":"{}"}`)
+
+	tests := []struct {
+		name    string
+		signer  apps.App
+		method  string
+		path    string
+		body    []byte
+		handler http.HandlerFunc
+		status  int
+	}{
+		{"extra key reads its app", backend, http.MethodGet, "/apps/1/channels", nil, s.HandleChannels, http.StatusOK},
+		{"extra key triggers on its app", backend, http.MethodPost, "/apps/1/events", event, s.HandleEvents, http.StatusOK},
+		{"extra key of another app", backend, http.MethodGet, "/apps/2/channels", nil, s.HandleChannels, http.StatusUnauthorized},
+		{"read only key reads", reader, http.MethodGet, "/apps/1/channels", nil, s.HandleChannels, http.StatusOK},
+		{"read only key triggers", reader, http.MethodPost, "/apps/1/events", event, s.HandleEvents, http.StatusForbidden},
+		{"read only key triggers a batch", reader, http.MethodPost, "/apps/1/batch_events", batch, s.HandleBatchEvents, http.StatusForbidden},
+		{"read only key sends to a user", reader, http.MethodPost, "/apps/1/users/alice/events", userEvent, s.HandleUserEvents, http.StatusForbidden},
+		{"read only key terminates a user", reader, http.MethodPost, "/apps/1/users/alice/terminate_connections", nil, s.HandleTerminateUserConnections, http.StatusForbidden},
+		{"disabled key reads", revoked, http.MethodGet, "/apps/1/channels", nil, s.HandleChannels, http.StatusUnauthorized},
+		{"disabled key triggers", revoked, http.MethodPost, "/apps/1/events", event, s.HandleEvents, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		tt.handler(rec, signedRequest(tt.signer, tt.method, tt.path, tt.body))
+
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, rec.Code, tt.status, rec.Body.String())
+		}
+	}
+}
+
+func TestReloadApps(t *testing.T) {
+	kept := apps.App{ID: "kept", Key: "kept-key", Secret: "old-secret", Enabled: true}
+	removed := apps.App{ID: "removed", Key: "removed-key", Secret: "secret", Enabled: true}
+	disabled := apps.App{ID: "disabled", Key: "disabled-key", Secret: "secret", Enabled: true}
+	rekeyed := apps.App{ID: "rekeyed", Key: "old-key", Secret: "secret", Enabled: true}
+	s := newTestServer(t, kept, removed, disabled, rekeyed)
+
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleWebSocket))
+	t.Cleanup(ts.Close)
+
+	conns := map[string]*websocket.Conn{}
+	for _, app := range []apps.App{kept, removed, disabled, rekeyed} {
+		conns[app.ID], _ = dialApp(t, ts.URL, app.Key)
+	}
+
+	rotated := kept
+	rotated.Secret = "new-secret"
+	disabled.Enabled = false
+	rekeyed.Key = "new-key"
+	added := apps.App{ID: "added", Key: "added-key", Secret: "secret", Enabled: true}
+	writeApps(t, s, rotated, disabled, rekeyed, added)
+
+	if err := s.ReloadApps(s.configFile); err != nil {
+		t.Fatalf("ReloadApps: %v", err)
+	}
+
+	for _, id := range []string{"removed", "disabled", "rekeyed"} {
+		if code := closeCode(conns[id]); code != protocol.CloseApplicationDisabled {
+			t.Errorf("%s: connection closed with %d, want %d", id, code, protocol.CloseApplicationDisabled)
+		}
+	}
+
+	// a rotated secret doesn't affect connected clients
+	keptConn := conns["kept"]
+	if err := keptConn.WriteJSON(map[string]any{"event": protocol.EventPing, "data": "{}"}); err != nil {
+		t.Fatal(err)
+	}
+	var pong protocol.Message
+	if err := keptConn.ReadJSON(&pong); err != nil || pong.Event != protocol.EventPong {
+		t.Errorf("kept: got %+v, %v after the reload, want a pong", pong, err)
+	}
+
+	for _, key := range []string{"new-key", "added-key"} {
+		dialApp(t, ts.URL, key)
+	}
+	for _, key := range []string{"old-key", "removed-key", "disabled-key"} {
+		if ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/app/"+key, nil); err == nil {
+			ws.Close()
+			t.Errorf("%s: connected after the reload", key)
+		}
+	}
+
+	tests := []struct {
+		secret string
+		status int
+	}{
+		{"new-secret", http.StatusOK},
+		{"old-secret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		s.HandleChannels(rec, signedRequest(apps.App{Key: kept.Key, Secret: tt.secret}, http.MethodGet, "/apps/kept/channels", nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.secret, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestReloadKeepsUnsavedAdminChanges(t *testing.T) {
+	edited := apps.App{ID: "edited", Key: "edited-key", Secret: "secret", Name: "from file", Enabled: true}
+	deleted := apps.App{ID: "deleted", Key: "deleted-key", Secret: "secret", Enabled: true}
+	s := newTestServer(t, edited, deleted)
+	admin := s.AdminHandler("token")
+
+	requests := []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodPost, "/admin/apps", `{"id":"created","key":"created-key","secret":"secret"}`, http.StatusCreated},
+		{http.MethodPatch, "/admin/apps/edited", `{"name":"from admin"}`, http.StatusOK},
+		{http.MethodDelete, "/admin/apps/deleted", "", http.StatusNoContent},
+	}
+	for _, req := range requests {
+		if rec := adminRequest(admin, "token", req.method, req.path, req.body); rec.Code != req.status {
+			t.Fatalf("%s %s: status = %d, want %d: %s", req.method, req.path, rec.Code, req.status, rec.Body.String())
+		}
+	}
+
+	// the file still has the apps as they were, plus an app added to it
+	added := apps.App{ID: "added", Key: "added-key", Secret: "secret", Enabled: true}
+	writeApps(t, s, edited, deleted, added)
+	if err := s.ReloadApps(s.configFile); err != nil {
+		t.Fatalf("ReloadApps: %v", err)
+	}
+
+	if _, exists := s.appsManager.GetAppByID("created"); !exists {
+		t.Error("app created through the admin API is gone after the reload")
+	}
+	if app, exists := s.appsManager.GetAppByID("edited"); !exists || app.Name != "from admin" {
+		t.Errorf("edited app = %+v after the reload, want the name set through the admin API", app)
+	}
+	if _, exists := s.appsManager.GetAppByID("deleted"); exists {
+		t.Error("app deleted through the admin API is back after the reload")
+	}
+	if _, exists := s.appsManager.GetAppByID("added"); !exists {
+		t.Error("app added to the file is missing after the reload")
+	}
+}
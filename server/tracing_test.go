@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aelpxy/pulse/apps"
+	"github.com/aelpxy/pulse/tracing"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestTraceHTTPContinuesPublisherTrace(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := tracing.NewProvider(sdktrace.NewSimpleSpanProcessor(exporter), apps.TracingConfig{})
+	tracing.Install(provider)
+	t.Cleanup(func() { tracing.Install(noop.NewTracerProvider()) })
+
+	app := apps.App{ID: "1", Key: "key", Secret: "secret", Enabled: true}
+	s := newTestServer(t, app)
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+
+	req := signedRequest(app, http.MethodPost, "/apps/1/events", []byte(`{"name":"order-placed","channel":"orders","data":"{}"}`))
+	req.Header.Set("traceparent", traceparent)
+	rec := httptest.NewRecorder()
+	TraceHTTP(http.HandlerFunc(s.HandleEvents)).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+
+	root, found := spans["POST /apps/{app_id}/events"]
+	if !found {
+		t.Fatalf("no request span in %v", exporter.GetSpans().Snapshots())
+	}
+	if root.SpanKind != trace.SpanKindServer || root.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("request span kind = %v, parent = %v, want a server span under the publisher's span", root.SpanKind, root.Parent.SpanID())
+	}
+
+	for _, name := range []string{"POST /apps/{app_id}/events", "pulse.auth", "pulse.parse", "pulse.publish", "pulse.broadcast"} {
+		span, found := spans[name]
+		if !found {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if span.SpanContext.TraceID() != traceID {
+			t.Errorf("%s trace id = %s, want the incoming %s", name, span.SpanContext.TraceID(), traceID)
+		}
+	}
+
+	if spans["pulse.broadcast"].Parent.SpanID() != spans["pulse.publish"].SpanContext.SpanID() {
+		t.Error("pulse.broadcast is not a child of pulse.publish")
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aelpxy/pulse/protocol"
+)
+
+// userIDFromPath extracts {user_id} from /apps/{app_id}/users/{user_id}/...
+func userIDFromPath(w http.ResponseWriter, r *http.Request) (string, bool) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 5 || parts[3] == "" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return "", false
+	}
+	return parts[3], true
+}
+
+// HandleUserEvents serves POST /apps/{app_id}/users/{user_id}/events
+func (s *Server) HandleUserEvents(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	targetApp, ok := s.resolveApp(w, r)
+	if !ok {
+		return
+	}
+
+	userID, ok := userIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	maxBodySize := max(targetApp.GetMaxMessageSize(), protocol.MaxEventDataSize) + triggerEnvelopeSize
+	body, ok := readBody(w, r, maxBodySize)
+	if !ok {
+		return
+	}
+
+	if !s.authenticateRequest(w, r, targetApp, body) {
+		return
+	}
+
+	type UserEventRequest struct {
+		Name string `json:"name"`
+		Data string `json:"data"`
+	}
+
+	var event UserEventRequest
+	if err := decodeJSON(r.Context(), body, &event); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if status, err := validateEvent(event.Name, event.Data); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	s.connectionMgr.SendToUser(r.Context(), targetApp.ID, userID, event.Name, event.Data, received)
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{}`)
+}
+
+// HandleTerminateUserConnections serves POST /apps/{app_id}/users/{user_id}/terminate_connections
+func (s *Server) HandleTerminateUserConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	targetApp, ok := s.resolveApp(w, r)
+	if !ok {
+		return
+	}
+
+	userID, ok := userIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	body, ok := readBody(w, r, 10240)
+	if !ok {
+		return
+	}
+
+	if !s.authenticateRequest(w, r, targetApp, body) {
+		return
+	}
+
+	s.connectionMgr.TerminateUserConnections(targetApp.ID, userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{}`)
+}
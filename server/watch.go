@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/fsnotify/fsnotify"
+)
+
+// editors usually write a file in several steps, wait for them to settle
+const reloadDebounce = 500 * time.Millisecond
+
+// WatchConfig reloads the apps whenever configFile changes, until ctx is done.
+// The directory is watched rather than the file itself and changes are detected
+// by content, so files replaced by rename or through a symlink swap (as with
+// Kubernetes ConfigMaps) are picked up too.
+func (s *Server) WatchConfig(ctx context.Context, configFile string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create config watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+		return fmt.Errorf("failed to watch %s: %w", configFile, err)
+	}
+
+	lastHash := hashFile(configFile)
+	var debounce <-chan time.Time
+
+	log.Info("watching config for changes", "path", configFile)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			debounce = time.After(reloadDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Warn("config watcher error", "error", err)
+		case <-debounce:
+			debounce = nil
+
+			hash := hashFile(configFile)
+			if hash == nil || bytes.Equal(hash, lastHash) {
+				continue
+			}
+			lastHash = hash
+
+			log.Info("config changed, reloading apps", "path", configFile)
+			if err := s.ReloadApps(configFile); err != nil {
+				log.Error("failed to reload apps", "error", err)
+			}
+		}
+	}
+}
+
+// hashFile returns nil when the file can't be read, e.g. while it is being replaced
+func hashFile(path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
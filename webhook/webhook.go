@@ -0,0 +1,333 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aelpxy/pulse/apps"
+	"github.com/aelpxy/pulse/tracing"
+	"github.com/charmbracelet/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// webhook event names, see https://pusher.com/docs/channels/server_api/webhooks
+const (
+	EventChannelOccupied = "channel_occupied"
+	EventChannelVacated  = "channel_vacated"
+	EventMemberAdded     = "member_added"
+	EventMemberRemoved   = "member_removed"
+	EventClientEvent     = "client_event"
+)
+
+const (
+	queueSize     = 10000
+	deliverySize  = 1000
+	workers       = 8
+	batchInterval = 250 * time.Millisecond
+	maxBatchSize  = 100
+	maxAttempts   = 5
+	baseBackoff   = 500 * time.Millisecond
+	maxBackoff    = 30 * time.Second
+)
+
+type Event struct {
+	Name     string `json:"name"`
+	Channel  string `json:"channel"`
+	Event    string `json:"event,omitempty"`
+	Data     string `json:"data,omitempty"`
+	SocketID string `json:"socket_id,omitempty"`
+	UserID   string `json:"user_id,omitempty"`
+}
+
+type Payload struct {
+	TimeMs int64   `json:"time_ms"`
+	Events []Event `json:"events"`
+}
+
+type pendingEvent struct {
+	app   *apps.App
+	event Event
+}
+
+type batch struct {
+	app    *apps.App
+	events []Event
+}
+
+type delivery struct {
+	appID string
+	url   string
+	key   string
+	body  []byte
+	sig   string
+}
+
+// Dispatcher batches webhook events per app and delivers them asynchronously
+// from a bounded queue, retrying failed deliveries with exponential backoff
+type Dispatcher struct {
+	client     *http.Client
+	events     chan pendingEvent
+	deliveries chan delivery
+	done       chan struct{}
+	closed     atomic.Bool
+	closeOnce  sync.Once
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+// NewDispatcher starts a dispatcher, a nil client uses a default client with a 10s timeout
+func NewDispatcher(client *http.Client) *Dispatcher {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d := &Dispatcher{
+		client:     client,
+		events:     make(chan pendingEvent, queueSize),
+		deliveries: make(chan delivery, deliverySize),
+		done:       make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+
+	d.wg.Add(1)
+	go d.run()
+
+	for range workers {
+		d.wg.Add(1)
+		go d.worker()
+	}
+
+	return d
+}
+
+// Dispatch queues an event for the app's webhooks, dropping it if the queue is full
+func (d *Dispatcher) Dispatch(app *apps.App, event Event) {
+	if app == nil || !app.HasWebhook(event.Name) || d.closed.Load() {
+		return
+	}
+
+	select {
+	case d.events <- pendingEvent{app: app, event: event}:
+	default:
+		log.Warn("webhook queue full, dropping event", "app", app.ID, "event", event.Name, "channel", event.Channel)
+	}
+}
+
+func (d *Dispatcher) run() {
+	defer d.wg.Done()
+	defer close(d.deliveries)
+
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+
+	pending := make(map[string]*batch)
+
+	add := func(p pendingEvent) {
+		b, exists := pending[p.app.ID]
+		if !exists {
+			b = &batch{app: p.app}
+			pending[p.app.ID] = b
+		}
+		b.events = append(b.events, p.event)
+		if len(b.events) >= maxBatchSize {
+			d.flush(b)
+			delete(pending, p.app.ID)
+		}
+	}
+
+	flushAll := func() {
+		for appID, b := range pending {
+			d.flush(b)
+			delete(pending, appID)
+		}
+	}
+
+	for {
+		select {
+		case p := <-d.events:
+			add(p)
+		case <-ticker.C:
+			flushAll()
+		case <-d.done:
+			for {
+				select {
+				case p := <-d.events:
+					add(p)
+				default:
+					flushAll()
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush builds one signed payload per webhook url containing the events it accepts
+func (d *Dispatcher) flush(b *batch) {
+	timeMs := time.Now().UnixMilli()
+
+	for _, hook := range b.app.Webhooks {
+		events := make([]Event, 0, len(b.events))
+		for _, event := range b.events {
+			if hook.Accepts(event.Name) {
+				events = append(events, event)
+			}
+		}
+		if len(events) == 0 {
+			continue
+		}
+
+		body, err := json.Marshal(Payload{TimeMs: timeMs, Events: events})
+		if err != nil {
+			log.Error("failed to encode webhook payload", "app", b.app.ID, "error", err)
+			continue
+		}
+
+		del := delivery{
+			appID: b.app.ID,
+			url:   hook.URL,
+			key:   b.app.Key,
+			body:  body,
+			sig:   Sign(b.app.Secret, body),
+		}
+
+		select {
+		case d.deliveries <- del:
+		default:
+			log.Warn("webhook delivery queue full, dropping batch", "app", b.app.ID, "url", hook.URL, "events", len(events))
+		}
+	}
+}
+
+func (d *Dispatcher) worker() {
+	defer d.wg.Done()
+
+	for del := range d.deliveries {
+		d.deliver(del)
+	}
+}
+
+// deliver posts a batch until it succeeds or runs out of attempts, in a trace
+// of its own since batches aren't caused by a single request
+func (d *Dispatcher) deliver(del delivery) {
+	ctx, span := tracing.Start(d.ctx, "pulse.webhook.deliver",
+		trace.WithAttributes(
+			attribute.String("pulse.app_id", del.appID),
+			semconv.URLFull(del.url),
+		),
+	)
+	defer span.End()
+
+	backoff := baseBackoff
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err := d.post(ctx, del)
+		if err == nil {
+			span.SetAttributes(attribute.Int("pulse.attempts", attempt))
+			return
+		}
+
+		if attempt == maxAttempts {
+			span.SetAttributes(attribute.Int("pulse.attempts", attempt))
+			span.SetStatus(codes.Error, err.Error())
+			log.Error("webhook delivery failed", "app", del.appID, "url", del.url, "attempts", attempt, "error", err)
+			return
+		}
+
+		log.Debug("webhook delivery failed, retrying", "app", del.appID, "url", del.url, "attempt", attempt, "backoff", backoff, "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-d.ctx.Done():
+			span.SetStatus(codes.Error, "shutting down")
+			return
+		}
+
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func (d *Dispatcher) post(ctx context.Context, del delivery) error {
+	ctx, span := tracing.Start(ctx, "POST",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(http.MethodPost),
+			semconv.URLFull(del.url),
+		),
+	)
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, del.url, bytes.NewReader(del.body))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Pusher-Key", del.key)
+	req.Header.Set("X-Pusher-Signature", del.sig)
+	tracing.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	resp.Body.Close()
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err := fmt.Errorf("unexpected status %d", resp.StatusCode)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
+// Shutdown flushes queued events and waits for in-flight deliveries,
+// abandoning retries once the timeout expires
+func (d *Dispatcher) Shutdown(timeout time.Duration) error {
+	d.closeOnce.Do(func() {
+		d.closed.Store(true)
+		close(d.done)
+	})
+
+	finished := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		d.cancel()
+		return nil
+	case <-time.After(timeout):
+		d.cancel()
+		return fmt.Errorf("webhook shutdown timed out after %v", timeout)
+	}
+}
+
+// Sign returns the X-Pusher-Signature for a webhook body
+func Sign(secret string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,161 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aelpxy/pulse/apps"
+)
+
+type received struct {
+	key       string
+	signature string
+	body      []byte
+	payload   Payload
+}
+
+// newReceiver starts a webhook endpoint answering with the status returned
+// by status for the n-th request, counting from 1
+func newReceiver(t *testing.T, status func(n int) int) (*httptest.Server, chan received) {
+	t.Helper()
+
+	requests := make(chan received, 16)
+	var count atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		var payload Payload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("invalid payload %s: %v", body, err)
+		}
+		requests <- received{
+			key:       r.Header.Get("X-Pusher-Key"),
+			signature: r.Header.Get("X-Pusher-Signature"),
+			body:      body,
+			payload:   payload,
+		}
+		w.WriteHeader(status(int(count.Add(1))))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, requests
+}
+
+func ok(int) int { return http.StatusOK }
+
+func next(t *testing.T, requests chan received) received {
+	t.Helper()
+
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook received")
+		return received{}
+	}
+}
+
+func newTestDispatcher(t *testing.T) *Dispatcher {
+	d := NewDispatcher(nil)
+	t.Cleanup(func() { d.Shutdown(5 * time.Second) })
+	return d
+}
+
+func TestDispatchBatchesAndSigns(t *testing.T) {
+	server, requests := newReceiver(t, ok)
+	app := &apps.App{ID: "1", Key: "key", Secret: "secret", Webhooks: []apps.Webhook{{URL: server.URL}}}
+	d := newTestDispatcher(t)
+
+	start := time.Now()
+	d.Dispatch(app, Event{Name: EventChannelOccupied, Channel: "lobby"})
+	d.Dispatch(app, Event{Name: EventMemberAdded, Channel: "presence-lobby", UserID: "alice"})
+
+	r := next(t, requests)
+	if r.key != "key" {
+		t.Errorf("X-Pusher-Key = %q, want key", r.key)
+	}
+	if want := Sign("secret", r.body); r.signature != want {
+		t.Errorf("X-Pusher-Signature = %q, want %q", r.signature, want)
+	}
+
+	events := r.payload.Events
+	if len(events) != 2 || events[0].Name != EventChannelOccupied || events[1].Name != EventMemberAdded || events[1].UserID != "alice" {
+		t.Errorf("events = %+v, want channel_occupied and member_added in one batch", events)
+	}
+	if r.payload.TimeMs < start.UnixMilli() || r.payload.TimeMs > time.Now().UnixMilli() {
+		t.Errorf("time_ms = %d, want the time the batch was sent", r.payload.TimeMs)
+	}
+}
+
+func TestDispatchFiltersEventTypes(t *testing.T) {
+	channels, channelRequests := newReceiver(t, ok)
+	members, memberRequests := newReceiver(t, ok)
+	app := &apps.App{ID: "1", Key: "key", Secret: "secret", Webhooks: []apps.Webhook{
+		{URL: channels.URL, EventTypes: []string{EventChannelOccupied, EventChannelVacated}},
+		{URL: members.URL, EventTypes: []string{EventMemberAdded}},
+	}}
+	d := newTestDispatcher(t)
+
+	d.Dispatch(app, Event{Name: EventChannelOccupied, Channel: "presence-lobby"})
+	d.Dispatch(app, Event{Name: EventMemberAdded, Channel: "presence-lobby", UserID: "alice"})
+	d.Dispatch(app, Event{Name: EventClientEvent, Channel: "presence-lobby", Event: "client-typing"})
+
+	if events := next(t, channelRequests).payload.Events; len(events) != 1 || events[0].Name != EventChannelOccupied {
+		t.Errorf("channel hook events = %+v, want only channel_occupied", events)
+	}
+	if events := next(t, memberRequests).payload.Events; len(events) != 1 || events[0].Name != EventMemberAdded {
+		t.Errorf("member hook events = %+v, want only member_added", events)
+	}
+
+	// client events match no hook and must not be sent anywhere
+	select {
+	case r := <-channelRequests:
+		t.Errorf("unexpected channel hook %s", r.body)
+	case r := <-memberRequests:
+		t.Errorf("unexpected member hook %s", r.body)
+	case <-time.After(2 * batchInterval):
+	}
+
+	if app.HasWebhook(EventClientEvent) {
+		t.Error("HasWebhook(client_event) = true, no hook accepts it")
+	}
+}
+
+func TestDispatchRetriesFailedDelivery(t *testing.T) {
+	server, requests := newReceiver(t, func(n int) int {
+		if n == 1 {
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	})
+	app := &apps.App{ID: "1", Key: "key", Secret: "secret", Webhooks: []apps.Webhook{{URL: server.URL}}}
+	d := newTestDispatcher(t)
+
+	d.Dispatch(app, Event{Name: EventChannelVacated, Channel: "lobby"})
+
+	first := next(t, requests)
+	retry := next(t, requests)
+	if string(retry.body) != string(first.body) || retry.signature != first.signature {
+		t.Errorf("retry sent %s, want the failed batch %s again", retry.body, first.body)
+	}
+
+	select {
+	case r := <-requests:
+		t.Errorf("delivery retried after it succeeded: %s", r.body)
+	case <-time.After(2 * baseBackoff):
+	}
+}
+
+func TestSign(t *testing.T) {
+	// HMAC-SHA256 of the body with the app secret, hex encoded
+	const want = "7f7f57446968d787e73e1325b85147edc7991af069e8fffdc6a4e6fcc288693c"
+	if got := Sign("secret", []byte(`{"time_ms":1,"events":[]}`)); got != want {
+		t.Errorf("Sign = %s, want %s", got, want)
+	}
+}